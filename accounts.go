@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	minUsernameLen = 3
+	maxUsernameLen = 32
+	minPasswordLen = 8
+	// bcrypt only looks at the first 72 bytes and refuses longer input.
+	maxPasswordBytes = 72
+)
+
+// normalizeUsername is applied to every username we receive, so "Alice " and
+// "alice" are the same account.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// validateUsername checks a normalized username: 3 to 32 characters out of
+// a-z, 0-9, '.', '_' and '-', starting with a letter or digit.
+func validateUsername(username string) *fieldError {
+	switch {
+	case username == "":
+		return &fieldError{"username", "is required"}
+	case len(username) < minUsernameLen || len(username) > maxUsernameLen:
+		return &fieldError{"username", "must be between 3 and 32 characters"}
+	case !isAlnum(rune(username[0])):
+		return &fieldError{"username", "must start with a letter or digit"}
+	}
+	for _, c := range username {
+		if !isAlnum(c) && c != '.' && c != '_' && c != '-' {
+			return &fieldError{"username", "may only contain letters, digits, '.', '_' and '-'"}
+		}
+	}
+	return nil
+}
+
+func isAlnum(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// validatePassword is the password policy for new accounts: at least 8
+// characters from at least two of lowercase, uppercase, digits and symbols,
+// no longer than bcrypt can hash, and not containing the username.
+func validatePassword(password, username string) *fieldError {
+	switch {
+	case password == "":
+		return &fieldError{"password", "is required"}
+	case len([]rune(password)) < minPasswordLen:
+		return &fieldError{"password", "must be at least 8 characters"}
+	case len(password) > maxPasswordBytes:
+		return &fieldError{"password", "must be at most 72 bytes"}
+	case username != "" && strings.Contains(strings.ToLower(password), username):
+		return &fieldError{"password", "must not contain the username"}
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok {
+			classes++
+		}
+	}
+	if classes < 2 {
+		return &fieldError{"password", "must mix at least two of lowercase, uppercase, digits and symbols"}
+	}
+	return nil
+}
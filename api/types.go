@@ -1,6 +1,8 @@
 package api
 
 import (
+	"time"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -8,15 +10,125 @@ type User struct {
 	ID           int    `json:"id"`
 	Username     string `json:"username"`
 	PasswordHash string `json:"-"`
+	TokenVersion int    `json:"-"`
 }
 
+// Todo priorities, from "no priority" up to the most urgent.
+const (
+	PriorityNone   = 0
+	PriorityLow    = 1
+	PriorityMedium = 2
+	PriorityHigh   = 3
+)
+
+// Todo is a single task. CreatedAt, UpdatedAt, CompletedAt, Progress,
+// Version and DeletedAt are managed by the store; values sent by clients are
+// ignored.
 type Todo struct {
-	ID        int    `json:"id"`
-	Task      string `json:"task"`
-	Completed bool   `json:"completed"`
+	ID int `json:"id"`
+	// ListID is the list the todo belongs to. Creating a todo without one
+	// puts it in the user's inbox, updating without one keeps it where it is.
+	ListID      int        `json:"list_id"`
+	Task        string     `json:"task"`
+	Completed   bool       `json:"completed"`
+	Priority    int        `json:"priority"`
+	DueAt       *time.Time `json:"due_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	Progress    Progress   `json:"progress"`
+	// Version goes up with every change and is sent as the todo's ETag.
+	Version int `json:"version"`
+	// Tags are the names of the asking user's tags on the todo, sorted. On
+	// create and update they replace that user's tags, creating missing
+	// ones; leaving them out of an update keeps the current tags.
+	Tags []string `json:"tags"`
+	// Recurrence is an RRULE like "FREQ=WEEKLY;BYDAY=MO" and needs DueAt.
+	// Completing a recurring todo creates the next occurrence as a new todo,
+	// and the completed one stops recurring. Timezone is the IANA zone the
+	// occurrences keep their wall clock time in; empty means UTC.
+	Recurrence string `json:"recurrence,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+	// DeletedAt is when the todo was moved to the trash; only trashed todos
+	// have one.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Progress counts the subtasks of a todo. A todo with subtasks is completed
+// once all of them are.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Subtask is a checklist item under a todo, kept in Position order.
+type Subtask struct {
+	ID          int        `json:"id"`
+	TodoID      int        `json:"todo_id"`
+	Task        string     `json:"task"`
+	Completed   bool       `json:"completed"`
+	Position    int        `json:"position"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// Tag labels todos. Tags belong to one user and names are unique per user.
+type Tag struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TodoPage is the envelope for list responses. NextCursor is only set when
+// HasMore is true and is passed back as ?cursor= to get the following page.
+type TodoPage struct {
+	Data       []Todo `json:"data"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// Roles a member can have on a list. Owners manage the list and its members,
+// editors change todos, viewers only read.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// List groups todos and is shared by its members. Every user has an inbox
+// list that is theirs alone.
+type List struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Inbox     bool      `json:"inbox"`
+	Role      string    `json:"role"` // of the user asking
+	CreatedAt time.Time `json:"created_at"`
+	// Members is only filled in when a single list is fetched.
+	Members []Member `json:"members,omitempty"`
+}
+
+type Member struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// Invite offers a user a role on a list until they accept or decline it.
+type Invite struct {
+	ID        int       `json:"id"`
+	ListID    int       `json:"list_id"`
+	ListName  string    `json:"list_name"`
+	Username  string    `json:"username"` // who is invited
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
+// Claims are carried by every access token. The token ID (jti) lives in
+// RegisteredClaims.ID and is what /logout revokes; TokenVersion must match the
+// user's current version, which /logout/all bumps.
 type Claims struct {
-	UserID int `json:"user_id"`
+	UserID       int `json:"user_id"`
+	TokenVersion int `json:"ver"`
 	jwt.RegisteredClaims
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"todo-api-v1/api"
+	"todo-api-v1/store"
+)
+
+const maxBatchOps = 100
+
+const (
+	batchAtomic      = "atomic"
+	batchIndependent = "independent"
+)
+
+// batchRequest is the body of POST /todos/batch.
+type batchRequest struct {
+	Mode       string    `json:"mode"` // atomic (the default) or independent
+	Operations []batchOp `json:"operations"`
+}
+
+// batchOp is one operation: create takes todo; update takes id and the whole
+// todo; patch takes id and a merge patch; complete and delete take id.
+// version makes any but create conditional, like If-Match.
+type batchOp struct {
+	Op      string                     `json:"op"`
+	ID      int                        `json:"id"`
+	Version int                        `json:"version"`
+	Todo    api.Todo                   `json:"todo"`
+	Patch   map[string]json.RawMessage `json:"patch"`
+}
+
+type batchResult struct {
+	Status int       `json:"status"`
+	Todo   *api.Todo `json:"todo,omitempty"`
+	Error  *apiError `json:"error,omitempty"`
+}
+
+// batchTodos runs up to maxBatchOps todo writes in one transaction. In atomic
+// mode the first failing operation fails the whole request with its error,
+// and nothing is written. In independent mode every operation succeeds or
+// fails on its own and the response lists a status per operation.
+func (s *Server) batchTodos(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(int)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return
+	}
+	switch {
+	case req.Mode == "":
+		req.Mode = batchAtomic
+	case req.Mode != batchAtomic && req.Mode != batchIndependent:
+		s.writeError(w, r, errInvalid(fieldError{"mode", "must be atomic or independent"}))
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > maxBatchOps {
+		s.writeError(w, r, errInvalid(fieldError{"operations",
+			fmt.Sprintf("must hold between 1 and %d operations", maxBatchOps)}))
+		return
+	}
+	atomic := req.Mode == batchAtomic
+
+	// Operations that are invalid on their own never reach the store. Patches
+	// are merged into the todo as it is now, so a patch is checked against
+	// the state before the batch.
+	results := make([]batchResult, len(req.Operations))
+	var ops []store.TodoOp
+	var opIndex []int // into req.Operations, by ops index
+	for i, op := range req.Operations {
+		storeOp, err := s.batchStoreOp(ctx, userID, op)
+		if err != nil {
+			e := batchOpError(i, op, err)
+			if atomic {
+				s.writeError(w, r, e)
+				return
+			}
+			results[i] = batchResult{Status: e.Status, Error: e}
+			continue
+		}
+		ops = append(ops, storeOp)
+		opIndex = append(opIndex, i)
+	}
+
+	var done []store.TodoOpResult
+	if len(ops) > 0 {
+		var err error
+		if done, err = s.store.BatchTodos(ctx, userID, ops, atomic); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+
+	var changed []int
+	for j, res := range done {
+		i, op := opIndex[j], req.Operations[opIndex[j]]
+		if res.Err != nil {
+			if errors.Is(res.Err, store.ErrRolledBack) {
+				continue
+			}
+			e := batchOpError(i, op, res.Err)
+			if atomic {
+				s.writeError(w, r, e)
+				return
+			}
+			if e.Status >= http.StatusInternalServerError {
+				s.log(ctx).Error("batch operation failed", "index", i, "op", op.Op, "err", res.Err)
+			}
+			results[i] = batchResult{Status: e.Status, Error: e}
+			continue
+		}
+		switch ops[j].Kind {
+		case store.OpCreate:
+			todo := res.Todo
+			results[i] = batchResult{Status: http.StatusCreated, Todo: &todo}
+		case store.OpPatch:
+			todo := res.Todo
+			results[i] = batchResult{Status: http.StatusOK, Todo: &todo}
+			changed = append(changed, op.ID)
+		case store.OpDelete:
+			results[i] = batchResult{Status: http.StatusNoContent}
+			changed = append(changed, op.ID)
+		}
+	}
+	s.invalidateTodo(ctx, changed...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results []batchResult `json:"results"`
+	}{results})
+}
+
+// batchStoreOp validates op and turns it into the store operation.
+func (s *Server) batchStoreOp(ctx context.Context, userID int, op batchOp) (store.TodoOp, error) {
+	if op.Op != "create" && op.ID <= 0 {
+		return store.TodoOp{}, errInvalid(fieldError{"id", "is required"})
+	}
+	switch op.Op {
+	case "create":
+		t := op.Todo
+		t.Tags = normalizeTags(t.Tags)
+		t.Recurrence = normalizeRecurrence(t.Recurrence)
+		if err := validateTodo(t); err != nil {
+			return store.TodoOp{}, err
+		}
+		return store.TodoOp{Kind: store.OpCreate, Todo: t}, nil
+
+	case "update":
+		t := op.Todo
+		t.Tags = normalizeTags(t.Tags)
+		t.Recurrence = normalizeRecurrence(t.Recurrence)
+		if err := validateTodo(t); err != nil {
+			return store.TodoOp{}, err
+		}
+		t.ID, t.Version = op.ID, op.Version
+		return store.TodoOp{Kind: store.OpPatch, Patch: store.ReplaceTodo(t)}, nil
+
+	case "patch":
+		if op.Patch == nil {
+			return store.TodoOp{}, errInvalid(fieldError{"patch", "must be a JSON object"})
+		}
+		current, err := s.store.GetUserTodo(ctx, userID, op.ID)
+		if err != nil {
+			return store.TodoOp{}, err
+		}
+		if op.Version != 0 && op.Version != current.Version {
+			return store.TodoOp{}, store.ErrVersionMismatch
+		}
+		patch, merged, err := mergeTodoPatch(current, op.Patch)
+		if err != nil {
+			return store.TodoOp{}, err
+		}
+		if err := validateTodo(merged); err != nil {
+			return store.TodoOp{}, err
+		}
+		patch.ID, patch.IfVersion = op.ID, op.Version
+		return store.TodoOp{Kind: store.OpPatch, Patch: patch}, nil
+
+	case "complete":
+		completed := true
+		return store.TodoOp{Kind: store.OpPatch,
+			Patch: store.TodoPatch{ID: op.ID, Completed: &completed, IfVersion: op.Version}}, nil
+
+	case "delete":
+		return store.TodoOp{Kind: store.OpDelete, Patch: store.TodoPatch{ID: op.ID, IfVersion: op.Version}}, nil
+	}
+	return store.TodoOp{}, errInvalid(fieldError{"op", "must be create, update, patch, complete or delete"})
+}
+
+// batchOpError is err as the client sees it, naming the operation it belongs
+// to and with fields given as operations[i].field.
+func batchOpError(i int, op batchOp, err error) *apiError {
+	if errors.Is(err, store.ErrNotFound) {
+		if op.Op == "create" {
+			err = errNotFound("List not found")
+		} else {
+			err = errNotFound("Todo not found")
+		}
+	}
+	e := *toAPIError(err)
+	e.Message = fmt.Sprintf("Operation %d (%s): %s", i, op.Op, e.Message)
+	if e.Details != nil {
+		details := make([]fieldError, len(e.Details))
+		for k, d := range e.Details {
+			details[k] = fieldError{fmt.Sprintf("operations[%d].%s", i, d.Field), d.Message}
+		}
+		e.Details = details
+	}
+	return &e
+}
@@ -0,0 +1,144 @@
+// Package cache is the Redis cache-aside layer for todos.
+//
+// Entries are scoped to the user that read them, so a cached todo can never be
+// served to somebody the store would not have returned it to. Each todo also
+// has a version counter that is part of every entry key; invalidating a todo
+// just bumps the counter, which makes every user's entry for it unreachable at
+// once and also wins against a reader that is about to write back a stale row.
+// Users have a counter of their own as well, bumped when they lose access to a
+// list, which drops everything cached for them in one go.
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"todo-api-v1/api"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix is bumped whenever the cached representation of api.Todo changes,
+// so old entries are simply never read again.
+const keyPrefix = "todo:v5"
+
+const (
+	defaultTTL = 5 * time.Minute
+	// versionTTL must stay well above the entry TTL, otherwise a counter could
+	// expire and restart underneath entries that are still alive.
+	versionTTL = 24 * time.Hour
+)
+
+// ErrMiss is returned by GetTodo when nothing usable is cached.
+var ErrMiss = errors.New("cache miss")
+
+type Cache struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func New(rdb *redis.Client) *Cache {
+	return &Cache{rdb: rdb, ttl: defaultTTL}
+}
+
+// Version is the pair of counters an entry was cached under.
+type Version struct {
+	todo, user int64
+}
+
+func versionKey(todoID int) string {
+	return fmt.Sprintf("%s:%d:version", keyPrefix, todoID)
+}
+
+func userVersionKey(userID int) string {
+	return fmt.Sprintf("%s:user:%d:version", keyPrefix, userID)
+}
+
+func todoKey(userID, todoID int, v Version) string {
+	return fmt.Sprintf("%s:%d:user:%d:v%d.%d", keyPrefix, todoID, userID, v.todo, v.user)
+}
+
+func (c *Cache) version(ctx context.Context, userID, todoID int) (Version, error) {
+	vals, err := c.rdb.MGet(ctx, versionKey(todoID), userVersionKey(userID)).Result()
+	if err != nil {
+		return Version{}, err
+	}
+	var counters [2]int64
+	for i, val := range vals {
+		if val == nil {
+			continue
+		}
+		str, _ := val.(string)
+		if counters[i], err = strconv.ParseInt(str, 10, 64); err != nil {
+			return Version{}, err
+		}
+	}
+	return Version{todo: counters[0], user: counters[1]}, nil
+}
+
+// GetTodo returns the todo cached for this user. On ErrMiss the returned
+// version must be handed to SetTodo along with the row loaded from the store.
+func (c *Cache) GetTodo(ctx context.Context, userID, todoID int) (api.Todo, Version, error) {
+	version, err := c.version(ctx, userID, todoID)
+	if err != nil {
+		return api.Todo{}, Version{}, err
+	}
+
+	val, err := c.rdb.Get(ctx, todoKey(userID, todoID, version)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return api.Todo{}, version, ErrMiss
+	}
+	if err != nil {
+		return api.Todo{}, Version{}, err
+	}
+
+	var t api.Todo
+	if err := json.Unmarshal(val, &t); err != nil {
+		// Treat garbage like a miss; the write back will overwrite it.
+		return api.Todo{}, version, ErrMiss
+	}
+	return t, version, nil
+}
+
+// SetTodo caches t for userID under the version seen by GetTodo. If the todo
+// was invalidated in between, the entry lands under a dead key and is never read.
+func (c *Cache) SetTodo(ctx context.Context, userID int, t api.Todo, version Version) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return c.rdb.Set(ctx, todoKey(userID, t.ID, version), data, c.ttl).Err()
+}
+
+// InvalidateTodo drops every cached copy of the given todos, for all users.
+// It is the one call writers need after changing or deleting todos; the
+// todos of one call are invalidated together.
+func (c *Cache) InvalidateTodo(ctx context.Context, todoIDs ...int) error {
+	keys := make([]string, len(todoIDs))
+	for i, id := range todoIDs {
+		keys[i] = versionKey(id)
+	}
+	return c.bump(ctx, keys...)
+}
+
+// InvalidateUser drops every todo cached for one user. Call it when the user
+// loses access to a list, since their entries for its todos are still alive.
+func (c *Cache) InvalidateUser(ctx context.Context, userID int) error {
+	return c.bump(ctx, userVersionKey(userID))
+}
+
+func (c *Cache) bump(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	pipe := c.rdb.TxPipeline()
+	for _, key := range keys {
+		pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, versionTTL)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
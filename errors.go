@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"todo-api-v1/store"
+)
+
+// Error codes clients can switch on. Messages are for humans and may change.
+const (
+	codeBadRequest           = "bad_request"
+	codeValidation           = "validation_failed"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeConflict             = "conflict"
+	codePreconditionFailed   = "precondition_failed"
+	codeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	codeIdempotencyKeyReused = "idempotency_key_reused"
+	codeUsernameTaken        = "username_taken"
+	codeRateLimited          = "rate_limited"
+	codeTimeout              = "timeout"
+	codeUnavailable          = "unavailable"
+	codeInternal             = "internal"
+)
+
+// apiError is the body of every error response:
+//
+//	{"error": {"code": "validation_failed", "message": "...", "request_id": "...",
+//	           "details": [{"field": "task", "message": "is required"}]}}
+type apiError struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"request_id,omitempty"`
+	Details   []fieldError `json:"details,omitempty"`
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{Status: status, Code: code, Message: message}
+}
+
+func errBadRequest(message string) *apiError {
+	return newAPIError(http.StatusBadRequest, codeBadRequest, message)
+}
+
+func errUnauthorized(message string) *apiError {
+	return newAPIError(http.StatusUnauthorized, codeUnauthorized, message)
+}
+
+func errNotFound(message string) *apiError {
+	return newAPIError(http.StatusNotFound, codeNotFound, message)
+}
+
+var errMethodNotAllowed = newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+
+var errPreconditionFailed = newAPIError(http.StatusPreconditionFailed, codePreconditionFailed,
+	"The todo has changed since the version in If-Match")
+
+var errUsernameTaken = &apiError{
+	Status:  http.StatusConflict,
+	Code:    codeUsernameTaken,
+	Message: "Username is already taken",
+	Details: []fieldError{{"username", "is already taken"}},
+}
+
+// errInvalid reports problems with individual fields of the request body or
+// query string, all at once.
+func errInvalid(details ...fieldError) *apiError {
+	e := newAPIError(http.StatusBadRequest, codeValidation, "The request has invalid fields")
+	e.Details = details
+	return e
+}
+
+// toAPIError maps err onto what the client is allowed to see. Store and
+// context errors get their matching status; anything unexpected becomes a
+// bare 500 so driver messages never leave the server.
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, store.ErrNotFound):
+		return errNotFound("Not found")
+	case errors.Is(err, store.ErrForbidden):
+		return newAPIError(http.StatusForbidden, codeForbidden, "Your role on this list does not allow that")
+	case errors.Is(err, store.ErrVersionMismatch):
+		return errPreconditionFailed
+	case errors.Is(err, store.ErrConflict):
+		return newAPIError(http.StatusConflict, codeConflict, "The resource already exists")
+	case errors.Is(err, context.DeadlineExceeded):
+		return newAPIError(http.StatusGatewayTimeout, codeTimeout, "Request timed out")
+	}
+	return newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error")
+}
+
+// writeError sends err as a JSON error envelope. Errors that turn into a 5xx
+// are logged with the request so the request_id in the response finds them.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := *toAPIError(err)
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		e.RequestID = info.id
+	}
+	if e.Status >= http.StatusInternalServerError {
+		s.log(r.Context()).Error("request failed", "status", e.Status, "err", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(struct {
+		Error apiError `json:"error"`
+	}{e})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"todo-api-v1/api"
+)
+
+// todoETag is the strong ETag of a todo: its version.
+func todoETag(t api.Todo) string {
+	return `"` + strconv.Itoa(t.Version) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists etag.
+// If-None-Match compares weakly (RFC 9110 13.1.2), so W/ prefixes are
+// ignored; If-Match compares strongly and weak tags never match.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified answers a conditional GET whose If-None-Match already names
+// etag with 304 and reports whether it did. The ETag is set either way.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if h := r.Header.Get("If-None-Match"); h != "" && etagMatches(h, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// writeTodo sends t with its ETag. A GET whose If-None-Match names the
+// current version gets 304 Not Modified instead.
+func writeTodo(w http.ResponseWriter, r *http.Request, status int, t api.Todo) {
+	if r.Method == http.MethodGet && notModified(w, r, todoETag(t)) {
+		return
+	}
+	w.Header().Set("ETag", todoETag(t))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(t)
+}
+
+// writeTodoPage sends a page of todos. Its ETag is a hash of the body, so it
+// changes whenever any todo on the page, or the page itself, does.
+func writeTodoPage(w http.ResponseWriter, r *http.Request, page api.TodoPage) {
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(page)
+	sum := sha256.Sum256(body.Bytes())
+	if notModified(w, r, `"`+hex.EncodeToString(sum[:16])+`"`) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body.Bytes())
+}
+
+// ifMatchVersion turns the If-Match header of a write into the version the
+// store has to find: 0 without the header, and errPreconditionFailed when
+// the todo has already moved past every listed ETag. The store checks the
+// version again as part of the write, which closes the race.
+func (s *Server) ifMatchVersion(ctx context.Context, r *http.Request, userID, id int) (int, error) {
+	h := r.Header.Get("If-Match")
+	if h == "" {
+		return 0, nil
+	}
+	current, err := s.store.GetUserTodo(ctx, userID, id)
+	if err != nil {
+		return 0, err
+	}
+	return checkIfMatch(h, current)
+}
+
+func checkIfMatch(header string, current api.Todo) (int, error) {
+	if !etagMatches(header, todoETag(current), false) {
+		return 0, errPreconditionFailed
+	}
+	return current.Version, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds each dependency check so a hanging dependency fails the
+// probe instead of hanging it.
+const checkTimeout = time.Second
+
+// Overall readiness states.
+const (
+	statusOK           = "ok"
+	statusDegraded     = "degraded"    // serving, but without the cache
+	statusUnavailable  = "unavailable" // a required dependency is down
+	statusShuttingDown = "shutting_down"
+)
+
+type checkResult struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+type readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// livezHandler only says the process is up and serving HTTP. It never looks
+// at dependencies: restarting the pod would not bring the database back.
+func (s *Server) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": statusOK})
+}
+
+// readyzHandler pings the database and Redis in parallel. The database is
+// required; without Redis we still serve from Postgres alone, so readiness
+// stays green and reports "degraded". The probe is unauthenticated, so why a
+// check failed is only logged.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(readiness{Status: statusShuttingDown})
+		return
+	}
+
+	checks := map[string]func(context.Context) error{
+		"database": s.store.Ping,
+		"redis":    func(ctx context.Context) error { return s.rdb.Ping(ctx).Err() },
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	resp := readiness{Status: statusOK, Checks: map[string]checkResult{}}
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			res := checkResult{Status: statusOK, LatencyMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				res.Status = statusUnavailable
+				s.log(ctx).Warn("readiness check failed", "check", name, "err", err)
+			}
+			mu.Lock()
+			resp.Checks[name] = res
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	switch {
+	case resp.Checks["database"].Status != statusOK:
+		resp.Status, code = statusUnavailable, http.StatusServiceUnavailable
+	case resp.Checks["redis"].Status != statusOK:
+		resp.Status = statusDegraded
+	}
+	if resp.Status != statusOK {
+		s.log(r.Context()).Warn("not fully ready", "status", resp.Status, "checks", resp.Checks)
+	}
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
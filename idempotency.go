@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+	"todo-api-v1/idempotency"
+)
+
+const (
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentBody caps what is held in memory to fingerprint a request.
+	maxIdempotentBody = 1 << 20
+)
+
+// replayedHeaders are the response headers kept for replay; the rest, like
+// rate limit state, describe the request that got them.
+var replayedHeaders = []string{"Content-Type", "ETag"}
+
+// idempotencyTTLFromEnv reads IDEMPOTENCY_TTL, e.g. "24h": how long responses
+// to requests with an Idempotency-Key are replayed.
+func idempotencyTTLFromEnv() (time.Duration, error) {
+	v := os.Getenv("IDEMPOTENCY_TTL")
+	if v == "" {
+		return idempotency.DefaultTTL, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("IDEMPOTENCY_TTL must be a duration like 24h, got %q", v)
+	}
+	return d, nil
+}
+
+// validIdempotencyKey accepts up to maxIdempotencyKeyLength printable ASCII
+// characters, enough for a UUID or any client's own scheme.
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotent lets clients retry next safely. When a request carries an
+// Idempotency-Key, its response is stored for the user and any later request
+// with the same key gets that response again, marked with
+// Idempotent-Replayed, instead of running next again. Reusing a key for a
+// different method, path or body is a 422, and a duplicate that arrives
+// while the first request is still running gets a 409 to retry later. 5xx
+// responses are not kept, so the retry runs for real. Without Redis requests
+// run as if they had no key.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			s.writeError(w, r, errBadRequest(fmt.Sprintf(
+				"Idempotency-Key must be 1 to %d printable ASCII characters", maxIdempotencyKeyLength)))
+			return
+		}
+		userID, ok := r.Context().Value(userKey).(int)
+		if !ok {
+			s.writeError(w, r, errUnauthorized("User not found in context"))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			s.writeError(w, r, errBadRequest("Invalid request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.New()
+		fmt.Fprintf(sum, "%s %s\n", r.Method, r.URL.Path)
+		sum.Write(body)
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+		claim, stored, err := s.idempotency.Begin(r.Context(), userID, key, fingerprint)
+		switch {
+		case errors.Is(err, idempotency.ErrMismatch):
+			s.writeError(w, r, newAPIError(http.StatusUnprocessableEntity, codeIdempotencyKeyReused,
+				"This Idempotency-Key was already used for a different request"))
+			return
+		case errors.Is(err, idempotency.ErrInFlight):
+			w.Header().Set("Retry-After", "1")
+			s.writeError(w, r, newAPIError(http.StatusConflict, codeIdempotencyKeyInUse,
+				"A request with this Idempotency-Key is still in progress"))
+			return
+		case err != nil:
+			s.log(r.Context()).Warn("idempotency lookup failed, running without", "err", err)
+			next(w, r)
+			return
+		case stored != nil:
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		// Whatever happens to the client, the claim must not stay behind.
+		ctx := context.WithoutCancel(r.Context())
+		defer func() {
+			if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+				if err := claim.Release(ctx); err != nil {
+					s.log(ctx).Warn("failed to release idempotency key", "err", err)
+				}
+				return
+			}
+			resp := idempotency.Response{Status: rec.status, Header: http.Header{}, Body: rec.body.Bytes()}
+			for _, name := range replayedHeaders {
+				if v := rec.header.Get(name); v != "" {
+					resp.Header.Set(name, v)
+				}
+			}
+			if err := claim.Complete(ctx, resp); err != nil {
+				s.log(ctx).Warn("failed to store idempotent response", "err", err)
+			}
+		}()
+		next(rec, r)
+	}
+}
+
+// idempotencyRecorder passes a response through while keeping a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
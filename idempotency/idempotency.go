@@ -0,0 +1,159 @@
+// Package idempotency remembers the responses to requests sent with an
+// Idempotency-Key header, so that a retried request gets the first response
+// again instead of being carried out twice.
+//
+// Keys are scoped to a user and live in Redis, shared by every replica. A
+// request claims its key before it runs; a duplicate arriving while the first
+// one is still running finds the claim and is turned away instead of running
+// alongside it. Claims are released again when the request did not produce a
+// response worth keeping, so the client can retry.
+package idempotency
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const keyPrefix = "idempotency:v1:"
+
+// DefaultTTL is how long responses are kept unless New is told otherwise.
+const DefaultTTL = 24 * time.Hour
+
+// claimTTL bounds how long a claim outlives a request that never finished,
+// e.g. because its pod died. It has to stay well above the handler timeouts.
+const claimTTL = 30 * time.Second
+
+// ErrMismatch is returned by Begin when the key was first used for a
+// different request.
+var ErrMismatch = errors.New("idempotency key reused for a different request")
+
+// ErrInFlight is returned by Begin while the first request with the key is
+// still running.
+var ErrInFlight = errors.New("request with this idempotency key still in progress")
+
+// Response is a response as stored for replay.
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body"`
+}
+
+// record is the value kept under a key: a claim while the first request
+// runs, its response afterwards.
+type record struct {
+	Fingerprint string    `json:"fingerprint"`
+	Claim       string    `json:"claim,omitempty"`
+	Response    *Response `json:"response,omitempty"`
+}
+
+type Store struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+// New returns a Store keeping responses in rdb for ttl, or DefaultTTL when
+// ttl is zero.
+func New(rdb *redis.Client, ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Store{rdb: rdb, ttl: ttl}
+}
+
+func redisKey(userID int, key string) string {
+	return fmt.Sprintf("%s%d:%s", keyPrefix, userID, key)
+}
+
+// Claim is a key held by the request that used it first. It has to be
+// either completed or released.
+type Claim struct {
+	s           *Store
+	key         string
+	value       string
+	fingerprint string
+}
+
+// Begin looks up userID's key for a request identified by fingerprint. The
+// first time, it claims the key and returns the Claim. Later it returns the
+// stored response, or ErrInFlight while there is none yet, or ErrMismatch
+// when the fingerprint differs from the first request's.
+func (s *Store) Begin(ctx context.Context, userID int, key, fingerprint string) (*Claim, *Response, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, nil, err
+	}
+	value, err := json.Marshal(record{Fingerprint: fingerprint, Claim: hex.EncodeToString(token)})
+	if err != nil {
+		return nil, nil, err
+	}
+	k := redisKey(userID, key)
+
+	// The record can expire between SET NX and GET; one more round settles
+	// it.
+	for attempt := 0; attempt < 2; attempt++ {
+		claimed, err := s.rdb.SetNX(ctx, k, value, claimTTL).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		if claimed {
+			return &Claim{s: s, key: k, value: string(value), fingerprint: fingerprint}, nil, nil
+		}
+
+		data, err := s.rdb.Get(ctx, k).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case rec.Fingerprint != fingerprint:
+			return nil, nil, ErrMismatch
+		case rec.Response == nil:
+			return nil, nil, ErrInFlight
+		}
+		return nil, rec.Response, nil
+	}
+	return nil, nil, ErrInFlight
+}
+
+// swapScript replaces or, without a new value, deletes KEYS[1] if it still
+// holds ARGV[1], so a claim that expired and was taken over by another
+// request is left alone.
+var swapScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if ARGV[2] == '' then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+end
+return 1
+`)
+
+// Complete stores resp as the response to every later request with the key.
+func (c *Claim) Complete(ctx context.Context, resp Response) error {
+	value, err := json.Marshal(record{Fingerprint: c.fingerprint, Response: &resp})
+	if err != nil {
+		return err
+	}
+	return swapScript.Run(ctx, c.s.rdb, []string{c.key}, c.value, value, c.s.ttl.Milliseconds()).Err()
+}
+
+// Release gives the key up without a response, so a retry runs afresh.
+func (c *Claim) Release(ctx context.Context) error {
+	return swapScript.Run(ctx, c.s.rdb, []string{c.key}, c.value, "", 0).Err()
+}
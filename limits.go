@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api-v1/ratelimit"
+)
+
+// RateLimits protects the unauthenticated endpoints against guessing and
+// signup floods.
+type RateLimits struct {
+	LoginPerIP    ratelimit.Rule
+	LoginPerUser  ratelimit.Rule
+	RegisterPerIP ratelimit.Rule
+	// UserReads and UserWrites are per-user quotas on /todos/, /tags/,
+	// /lists/ and /invites/, shared by all of a user's tokens and all API pods.
+	UserReads  ratelimit.Rule
+	UserWrites ratelimit.Rule
+	// LoginLockout locks a username after repeated wrong passwords.
+	LoginLockout ratelimit.Lockout
+	// TrustForwardedFor takes the client address from the last
+	// X-Forwarded-For entry, i.e. the one our own proxy added. Only turn it
+	// on behind a proxy that sets the header, otherwise clients pick their
+	// own address.
+	TrustForwardedFor bool
+}
+
+func defaultRateLimits() RateLimits {
+	return RateLimits{
+		LoginPerIP:    ratelimit.Rule{Limit: 20, Window: time.Minute},
+		LoginPerUser:  ratelimit.Rule{Limit: 10, Window: time.Minute},
+		RegisterPerIP: ratelimit.Rule{Limit: 10, Window: time.Hour},
+		UserReads:     ratelimit.Rule{Limit: 300, Window: time.Minute},
+		UserWrites:    ratelimit.Rule{Limit: 60, Window: time.Minute},
+		LoginLockout: ratelimit.Lockout{
+			Threshold: 5,
+			Window:    15 * time.Minute,
+			Base:      time.Minute,
+			Max:       time.Hour,
+		},
+	}
+}
+
+// rateLimitsFromEnv overrides the defaults with RATE_LIMIT_LOGIN_IP,
+// RATE_LIMIT_LOGIN_USER, RATE_LIMIT_REGISTER_IP, RATE_LIMIT_USER_READ and
+// RATE_LIMIT_USER_WRITE (e.g. "20/1m"),
+// LOGIN_LOCKOUT_THRESHOLD, LOGIN_LOCKOUT_WINDOW, LOGIN_LOCKOUT_BASE,
+// LOGIN_LOCKOUT_MAX and TRUST_FORWARDED_FOR.
+func rateLimitsFromEnv() (RateLimits, error) {
+	l := defaultRateLimits()
+
+	for name, dst := range map[string]*ratelimit.Rule{
+		"RATE_LIMIT_LOGIN_IP":    &l.LoginPerIP,
+		"RATE_LIMIT_LOGIN_USER":  &l.LoginPerUser,
+		"RATE_LIMIT_REGISTER_IP": &l.RegisterPerIP,
+		"RATE_LIMIT_USER_READ":   &l.UserReads,
+		"RATE_LIMIT_USER_WRITE":  &l.UserWrites,
+	} {
+		if v := os.Getenv(name); v != "" {
+			rule, err := ratelimit.ParseRule(v)
+			if err != nil {
+				return l, fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = rule
+		}
+	}
+
+	if v := os.Getenv("LOGIN_LOCKOUT_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return l, fmt.Errorf("LOGIN_LOCKOUT_THRESHOLD must be a positive number, got %q", v)
+		}
+		l.LoginLockout.Threshold = n
+	}
+	for name, dst := range map[string]*time.Duration{
+		"LOGIN_LOCKOUT_WINDOW": &l.LoginLockout.Window,
+		"LOGIN_LOCKOUT_BASE":   &l.LoginLockout.Base,
+		"LOGIN_LOCKOUT_MAX":    &l.LoginLockout.Max,
+	} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return l, fmt.Errorf("%s must be a duration like 15m, got %q", name, v)
+			}
+			*dst = d
+		}
+	}
+	if l.LoginLockout.Max < l.LoginLockout.Base {
+		return l, fmt.Errorf("LOGIN_LOCKOUT_MAX (%s) is below LOGIN_LOCKOUT_BASE (%s)", l.LoginLockout.Max, l.LoginLockout.Base)
+	}
+
+	if v := os.Getenv("TRUST_FORWARDED_FOR"); v != "" {
+		trust, err := strconv.ParseBool(v)
+		if err != nil {
+			return l, fmt.Errorf("TRUST_FORWARDED_FOR must be true or false, got %q", v)
+		}
+		l.TrustForwardedFor = trust
+	}
+	return l, nil
+}
+
+// clientIP is the address rate limits are keyed by.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.limits.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allow applies rule to key and answers 429 if it is used up. It reports
+// whether the request may go on.
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, key string, rule ratelimit.Rule) bool {
+	d := s.limiter.Allow(r.Context(), key, rule, s.now())
+	if d.Allowed {
+		return true
+	}
+	s.log(r.Context()).Info("rate limited", "key", key, "limit", rule.String())
+	s.tooManyRequests(w, r, d.Reset, "Too many requests, slow down")
+	return false
+}
+
+// userQuota enforces the per-user read and write quotas. It runs after
+// authMiddleware and reports the state of the quota in X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset (seconds until a request
+// frees up) on every response.
+func (s *Server) userQuota(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(userKey).(int)
+		if !ok {
+			s.writeError(w, r, errUnauthorized("User not found in context"))
+			return
+		}
+
+		kind, rule := "write", s.limits.UserWrites
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			kind, rule = "read", s.limits.UserReads
+		}
+		d := s.limiter.Allow(r.Context(), fmt.Sprintf("user:%d:%s", userID, kind), rule, s.now())
+
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(d.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(retryAfterSeconds(d.Reset)))
+		if !d.Allowed {
+			s.log(r.Context()).Info("user quota exceeded", "quota", kind, "limit", rule.String())
+			s.tooManyRequests(w, r, d.Reset, fmt.Sprintf("Too many %ss, try again later", kind))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// tooManyRequests answers 429 and tells the client when to come back.
+func (s *Server) tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	s.writeError(w, r, newAPIError(http.StatusTooManyRequests, codeRateLimited, message))
+}
+
+// retryAfterSeconds rounds up, so a client that waits as told is let in.
+func retryAfterSeconds(d time.Duration) int {
+	return max(int(math.Ceil(d.Seconds())), 1)
+}
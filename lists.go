@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api-v1/store"
+	"unicode/utf8"
+)
+
+const maxListNameLength = 100
+
+// listError maps the store's list errors onto responses that tell the client
+// which rule it ran into. notFound is the message for a list the user cannot
+// see.
+func listError(err error, notFound string) error {
+	switch {
+	case errors.Is(err, store.ErrNotMember):
+		return errNotFound("Member not found")
+	case errors.Is(err, store.ErrUnknownUser):
+		return errInvalid(fieldError{"username", "does not exist"})
+	case errors.Is(err, store.ErrInvalidRole):
+		return errInvalid(fieldError{"role", "must be owner, editor or viewer"})
+	case errors.Is(err, store.ErrNotFound):
+		return errNotFound(notFound)
+	case errors.Is(err, store.ErrLastOwner):
+		return newAPIError(http.StatusConflict, codeConflict, "A list needs at least one owner")
+	case errors.Is(err, store.ErrInbox):
+		return newAPIError(http.StatusConflict, codeConflict, "The inbox cannot be shared or deleted")
+	case errors.Is(err, store.ErrAlreadyMember):
+		return newAPIError(http.StatusConflict, codeConflict, "User is already a member of this list")
+	case errors.Is(err, store.ErrAlreadyInvited):
+		return newAPIError(http.StatusConflict, codeConflict, "User has already been invited to this list")
+	}
+	return err
+}
+
+func validateListName(name string) *fieldError {
+	switch {
+	case name == "":
+		return &fieldError{"name", "is required"}
+	case utf8.RuneCountInString(name) > maxListNameLength:
+		return &fieldError{"name", fmt.Sprintf("must be at most %d characters", maxListNameLength)}
+	}
+	return nil
+}
+
+func validateRole(role string) *fieldError {
+	if !store.ValidRole(role) {
+		return &fieldError{"role", "must be owner, editor or viewer"}
+	}
+	return nil
+}
+
+// listHandler serves /lists/, /lists/{id}, /lists/{id}/invites and
+// /lists/{id}/members/{userID}.
+func (s *Server) listHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(int)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/lists/"), "/")
+	if parts[0] == "" && len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			s.getLists(w, r, userID)
+		case http.MethodPost:
+			s.createList(w, r, userID)
+		default:
+			s.writeError(w, r, errMethodNotAllowed)
+		}
+		return
+	}
+
+	listID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		s.writeError(w, r, errBadRequest("Invalid list ID"))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			s.getList(w, r, userID, listID)
+		case http.MethodPut:
+			s.renameList(w, r, userID, listID)
+		case http.MethodDelete:
+			s.deleteList(w, r, userID, listID)
+		default:
+			s.writeError(w, r, errMethodNotAllowed)
+		}
+
+	case len(parts) == 2 && parts[1] == "invites":
+		if r.Method != http.MethodPost {
+			s.writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		s.createInvite(w, r, userID, listID)
+
+	case len(parts) == 3 && parts[1] == "members":
+		memberID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			s.writeError(w, r, errBadRequest("Invalid user ID"))
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			s.setMemberRole(w, r, userID, listID, memberID)
+		case http.MethodDelete:
+			s.removeMember(w, r, userID, listID, memberID)
+		default:
+			s.writeError(w, r, errMethodNotAllowed)
+		}
+
+	default:
+		s.writeError(w, r, errNotFound("No such endpoint"))
+	}
+}
+
+func (s *Server) getLists(w http.ResponseWriter, r *http.Request, userID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	lists, err := s.store.GetUserLists(ctx, userID)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lists)
+}
+
+func (s *Server) createList(w http.ResponseWriter, r *http.Request, userID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if fe := validateListName(body.Name); fe != nil {
+		s.writeError(w, r, errInvalid(*fe))
+		return
+	}
+
+	list, err := s.store.CreateList(ctx, userID, body.Name)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(list)
+}
+
+func (s *Server) getList(w http.ResponseWriter, r *http.Request, userID, listID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	list, err := s.store.GetUserList(ctx, userID, listID)
+	if err != nil {
+		s.writeError(w, r, listError(err, "List not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (s *Server) renameList(w http.ResponseWriter, r *http.Request, userID, listID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if fe := validateListName(body.Name); fe != nil {
+		s.writeError(w, r, errInvalid(*fe))
+		return
+	}
+
+	list, err := s.store.RenameList(ctx, userID, listID, body.Name)
+	if err != nil {
+		s.writeError(w, r, listError(err, "List not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// deleteList deletes a list and its todos. Everybody who was on it may still
+// have its todos cached, so their cache entries go as well.
+func (s *Server) deleteList(w http.ResponseWriter, r *http.Request, userID, listID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	members, err := s.store.DeleteList(ctx, userID, listID)
+	if err != nil {
+		s.writeError(w, r, listError(err, "List not found"))
+		return
+	}
+	for _, memberID := range members {
+		s.invalidateUser(ctx, memberID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createInvite(w http.ResponseWriter, r *http.Request, userID, listID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	var body struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return
+	}
+	body.Username = normalizeUsername(body.Username)
+	var invalid []fieldError
+	if body.Username == "" {
+		invalid = append(invalid, fieldError{"username", "is required"})
+	}
+	if fe := validateRole(body.Role); fe != nil {
+		invalid = append(invalid, *fe)
+	}
+	if len(invalid) > 0 {
+		s.writeError(w, r, errInvalid(invalid...))
+		return
+	}
+
+	invite, err := s.store.CreateInvite(ctx, userID, listID, body.Username, body.Role)
+	if err != nil {
+		s.writeError(w, r, listError(err, "List not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+func (s *Server) setMemberRole(w http.ResponseWriter, r *http.Request, userID, listID, memberID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return
+	}
+	if fe := validateRole(body.Role); fe != nil {
+		s.writeError(w, r, errInvalid(*fe))
+		return
+	}
+
+	if err := s.store.SetMemberRole(ctx, userID, listID, memberID, body.Role); err != nil {
+		s.writeError(w, r, listError(err, "List not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeMember takes a member off a list, or lets the caller leave it. The
+// member's cached todos are dropped since they may include the list's.
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request, userID, listID, memberID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	if err := s.store.RemoveMember(ctx, userID, listID, memberID); err != nil {
+		s.writeError(w, r, listError(err, "List not found"))
+		return
+	}
+	s.invalidateUser(ctx, memberID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// inviteHandler serves /invites/, /invites/{id} and /invites/{id}/accept for
+// the invites addressed to the caller.
+func (s *Server) inviteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(int)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/invites/"), "/")
+	if parts[0] == "" && len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			s.writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		invites, err := s.store.GetUserInvites(ctx, userID)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invites)
+		return
+	}
+
+	inviteID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		s.writeError(w, r, errBadRequest("Invalid invite ID"))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		if r.Method != http.MethodDelete {
+			s.writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		if err := s.store.DeclineInvite(ctx, userID, inviteID); err != nil {
+			s.writeError(w, r, listError(err, "Invite not found"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "accept":
+		if r.Method != http.MethodPost {
+			s.writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		list, err := s.store.AcceptInvite(ctx, userID, inviteID)
+		if err != nil {
+			s.writeError(w, r, listError(err, "Invite not found"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	default:
+		s.writeError(w, r, errNotFound("No such endpoint"))
+	}
+}
+
+func (s *Server) invalidateUser(ctx context.Context, userID int) {
+	if err := s.cache.InvalidateUser(ctx, userID); err != nil {
+		s.log(ctx).Warn("failed to invalidate cached todos of user", "member_id", userID, "err", err)
+	}
+}
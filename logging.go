@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// redactedKeys are attribute keys whose values never reach the logs, matched
+// case-insensitively.
+var redactedKeys = map[string]bool{
+	"authorization": true,
+	"password":      true,
+	"token":         true,
+	"refresh_token": true,
+	"jwt_secret":    true,
+}
+
+// redact is a slog ReplaceAttr hook that blanks out credentials.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	return a
+}
+
+// newLogger builds the process logger from LOG_LEVEL (debug, info, warn,
+// error; default info) and LOG_FORMAT (json or text; default json).
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact}
+
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("LOG_FORMAT must be json or text, got %q", format)
+}
+
+func loggerFromEnv() (*slog.Logger, error) {
+	return newLogger(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+}
+
+// requestInfo travels down the handler chain with the request. Handlers
+// further down enrich the logger, e.g. authMiddleware adds user_id, and the
+// access log line picks that up once the request is done.
+type requestInfo struct {
+	id     string
+	logger *slog.Logger
+}
+
+const requestInfoKey contextKey = "requestInfo"
+
+// log returns the logger for the request behind ctx, or the server's logger
+// outside of a request.
+func (s *Server) log(ctx context.Context) *slog.Logger {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info.logger
+	}
+	return s.logger
+}
+
+// validRequestID accepts IDs set by proxies, as long as they are short and
+// cannot forge extra log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// loggingRecorder remembers the status code written by a handler.
+type loggingRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *loggingRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *loggingRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *loggingRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logRequests tags every request with an ID, reusing the caller's
+// X-Request-ID when it sends a sane one, and writes one access log line per
+// request. Probes and metrics scrapes are only logged at debug level.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := s.now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			if id, err = newOpaqueToken(12); err != nil {
+				id = "unknown"
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{id: id, logger: s.logger.With("request_id", id)}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+		rec := &loggingRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := []any{
+			"method", r.Method,
+			"route", r.Pattern,
+			"status", status,
+			"duration_ms", s.now().Sub(start).Milliseconds(),
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case r.Pattern == "/livez" || r.Pattern == "/readyz" || r.Pattern == "/health" || r.Pattern == "/metrics":
+			level = slog.LevelDebug
+		}
+		info.logger.Log(r.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"todo-api-v1/store"
+)
+
+const migrateUsage = `usage: todo-api migrate <command>
+
+commands:
+  up        apply every pending migration
+  down [N]  revert the last N migrations (default 1)
+  status    list migrations and whether they are applied`
+
+// runMigrate implements the "migrate" subcommand. It only needs DB_SOURCE and,
+// for SQLite, STORE_DRIVER.
+func runMigrate(args []string) {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+	if err := migrate(args); err != nil {
+		fatal("migrate "+args[0]+" failed", "err", err)
+	}
+}
+
+// migrate runs one migrate command. It returns instead of exiting so the
+// store is closed on every path.
+func migrate(args []string) error {
+	steps := 1
+	if args[0] == "down" && len(args) > 1 {
+		var err error
+		if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+			return fmt.Errorf("invalid number of steps %q", args[1])
+		}
+	}
+
+	driver := os.Getenv("STORE_DRIVER")
+	if driver == "" {
+		driver = "postgres"
+	}
+	dbSource := os.Getenv("DB_SOURCE")
+	if dbSource == "" {
+		return errors.New("DB_SOURCE environment variable is not set")
+	}
+	st, err := store.OpenSQL(driver, dbSource)
+	if err != nil {
+		return fmt.Errorf("connect to the database: %w", err)
+	}
+	defer st.Close()
+
+	migrator, err := st.Migrator()
+	if err != nil {
+		return fmt.Errorf("load migrations: %w", err)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		ran, err := migrator.Up(ctx)
+		for _, m := range ran {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(ran) == 0 {
+			fmt.Println("no pending migrations")
+		}
+
+	case "down":
+		ran, err := migrator.Down(ctx, steps)
+		for _, m := range ran {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return fmt.Errorf("read migration status: %w", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return tw.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"time"
+	"todo-api-v1/api"
+	"todo-api-v1/store"
+)
+
+const mergePatchType = "application/merge-patch+json"
+
+// patchTodo applies an RFC 7396 JSON merge patch to a todo: fields in the body
+// are changed, fields left out keep their value, and null clears due_at,
+// recurrence, timezone and tags. Plain application/json is read the same way.
+func (s *Server) patchTodo(w http.ResponseWriter, r *http.Request, id int) {
+	userID, ok := r.Context().Value(userKey).(int)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mt, _, _ := mime.ParseMediaType(ct); mt != mergePatchType && mt != "application/json" {
+			s.writeError(w, r, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+				"PATCH takes a JSON merge patch ("+mergePatchType+")"))
+			return
+		}
+	}
+	// A patch that is not an object would replace the whole todo, which is
+	// never valid.
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body == nil {
+		s.writeError(w, r, errBadRequest("Invalid request body: a merge patch must be a JSON object"))
+		return
+	}
+
+	current, err := s.store.GetUserTodo(ctx, userID, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNotFound("Todo not found")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	ifVersion := 0
+	if h := r.Header.Get("If-Match"); h != "" {
+		if ifVersion, err = checkIfMatch(h, current); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	patch, merged, err := mergeTodoPatch(current, body)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	// The todo as it will be has to be valid, e.g. a recurrence still needs
+	// a due date.
+	if err := validateTodo(merged); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	patch.ID, patch.IfVersion = id, ifVersion
+	updated, err := s.store.PatchUserTodo(ctx, userID, patch)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNotFound("Todo not found")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	s.invalidateTodo(ctx, id)
+
+	writeTodo(w, r, http.StatusOK, updated)
+}
+
+// mergeTodoPatch turns a merge patch into the store patch and the todo it
+// would produce from current. Fields clients cannot set are ignored, as they
+// are by PUT.
+func mergeTodoPatch(current api.Todo, body map[string]json.RawMessage) (store.TodoPatch, api.Todo, error) {
+	var p store.TodoPatch
+	var invalid []fieldError
+	// decode reads a field into v; ok is false when the field is not in the
+	// patch or could not be read. null is only accepted when nullable.
+	decode := func(field string, v any, nullable bool, message string) (ok, null bool) {
+		raw, present := body[field]
+		if !present {
+			return false, false
+		}
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			if !nullable {
+				invalid = append(invalid, fieldError{field, "cannot be null"})
+				return false, false
+			}
+			return true, true
+		}
+		if err := json.Unmarshal(raw, v); err != nil {
+			invalid = append(invalid, fieldError{field, message})
+			return false, false
+		}
+		return true, false
+	}
+
+	merged := current
+	var task string
+	if ok, _ := decode("task", &task, false, "must be a string"); ok {
+		p.Task, merged.Task = &task, task
+	}
+	var completed bool
+	if ok, _ := decode("completed", &completed, false, "must be true or false"); ok {
+		p.Completed, merged.Completed = &completed, completed
+	}
+	var priority int
+	if ok, _ := decode("priority", &priority, false, "must be between 0 and 3"); ok {
+		p.Priority, merged.Priority = &priority, priority
+	}
+	var listID int
+	if ok, _ := decode("list_id", &listID, false, "must be a list ID"); ok {
+		p.ListID, merged.ListID = &listID, listID
+	}
+	var dueAt time.Time
+	if ok, null := decode("due_at", &dueAt, true, "must be an RFC 3339 time"); ok {
+		p.SetDueAt, p.DueAt = true, nil
+		if !null {
+			p.DueAt = &dueAt
+		}
+		merged.DueAt = p.DueAt
+	}
+	var recurrence string
+	if ok, _ := decode("recurrence", &recurrence, true, "must be a string"); ok {
+		recurrence = normalizeRecurrence(recurrence)
+		p.Recurrence, merged.Recurrence = &recurrence, recurrence
+	}
+	var timezone string
+	if ok, _ := decode("timezone", &timezone, true, "must be a string"); ok {
+		p.Timezone, merged.Timezone = &timezone, timezone
+	} else if merged.Recurrence == "" && merged.Timezone != "" {
+		// The time zone goes with the recurrence it belongs to.
+		p.Timezone, merged.Timezone = &timezone, ""
+	}
+	var tags []string
+	if ok, _ := decode("tags", &tags, true, "must be a list of names"); ok {
+		tags = normalizeTags(tags)
+		if tags == nil {
+			tags = []string{}
+		}
+		p.Tags, merged.Tags = tags, tags
+	}
+
+	if len(invalid) > 0 {
+		return p, merged, errInvalid(invalid...)
+	}
+	return p, merged, nil
+}
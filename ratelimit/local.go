@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many calls pass between scans for expired keys.
+const sweepEvery = 1024
+
+// local mirrors the Redis state in process memory, for when Redis is down.
+type local struct {
+	mu    sync.Mutex
+	hits  map[string]*window
+	fails map[string]*failState
+	calls int
+}
+
+type window struct {
+	size time.Duration
+	hits []time.Time // oldest first
+}
+
+type failState struct {
+	count       int
+	countEnd    time.Time
+	lockedUntil time.Time
+	strikes     int
+	strikesEnd  time.Time
+}
+
+func newLocal() *local {
+	return &local{hits: make(map[string]*window), fails: make(map[string]*failState)}
+}
+
+func (l *local) allow(key string, rule Rule, now time.Time) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maybeSweep(now)
+
+	w := l.hits[key]
+	if w == nil {
+		w = &window{}
+		l.hits[key] = w
+	}
+	w.size = rule.Window
+	w.prune(now)
+
+	allowed := len(w.hits) < rule.Limit
+	if allowed {
+		w.hits = append(w.hits, now)
+	}
+	return Decision{
+		Allowed:   allowed,
+		Limit:     rule.Limit,
+		Remaining: rule.Limit - len(w.hits),
+		Reset:     w.hits[0].Add(w.size).Sub(now),
+	}
+}
+
+func (w *window) prune(now time.Time) {
+	i := 0
+	for i < len(w.hits) && !w.hits[i].After(now.Add(-w.size)) {
+		i++
+	}
+	w.hits = w.hits[i:]
+}
+
+func (l *local) locked(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f := l.fails[key]; f != nil {
+		return max(f.lockedUntil.Sub(now), 0)
+	}
+	return 0
+}
+
+func (l *local) fail(key string, p Lockout, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maybeSweep(now)
+
+	f := l.fails[key]
+	if f == nil {
+		f = &failState{}
+		l.fails[key] = f
+	}
+	if !now.Before(f.countEnd) {
+		f.count, f.countEnd = 0, now.Add(p.Window)
+	}
+	f.count++
+	if f.count < p.Threshold {
+		return 0
+	}
+
+	f.count = 0
+	if !now.Before(f.strikesEnd) {
+		f.strikes = 0
+	}
+	f.strikes++
+	f.strikesEnd = now.Add(strikeMemory)
+	d := p.duration(f.strikes)
+	f.lockedUntil = now.Add(d)
+	return d
+}
+
+func (l *local) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f := l.fails[key]; f != nil {
+		f.count = 0
+	}
+}
+
+// maybeSweep drops keys with nothing left to remember, so the maps do not
+// grow with every address that ever showed up.
+func (l *local) maybeSweep(now time.Time) {
+	l.calls++
+	if l.calls%sweepEvery != 0 {
+		return
+	}
+	for key, w := range l.hits {
+		w.prune(now)
+		if len(w.hits) == 0 {
+			delete(l.hits, key)
+		}
+	}
+	for key, f := range l.fails {
+		if now.After(f.countEnd) && now.After(f.lockedUntil) && now.After(f.strikesEnd) {
+			delete(l.fails, key)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Package ratelimit implements sliding window rate limits and progressive
+// lockouts after repeated failures.
+//
+// State lives in Redis so every replica sees the same counters. When Redis
+// cannot be reached the Limiter falls back to counters kept in process, which
+// are per replica but still stop a single client from hammering one pod.
+//
+// All decisions are made against the time passed in by the caller rather than
+// the Redis clock, so they are deterministic in tests.
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const keyPrefix = "ratelimit:"
+
+// strikeMemory is how long a key's past lockouts count towards the length of
+// its next one.
+const strikeMemory = 24 * time.Hour
+
+// Rule allows Limit requests in any Window.
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// ParseRule reads a rule written as "<limit>/<window>", e.g. "20/1m".
+func ParseRule(s string) (Rule, error) {
+	limit, window, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rule{}, fmt.Errorf("rate limit must look like 20/1m, got %q", s)
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 {
+		return Rule{}, fmt.Errorf("rate limit %q must allow at least one request", s)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return Rule{}, fmt.Errorf("rate limit %q needs a positive window like 1m", s)
+	}
+	return Rule{Limit: n, Window: d}, nil
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%d/%s", r.Limit, r.Window)
+}
+
+// Decision is the outcome of Allow.
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the oldest request in the window expires and
+	// frees a slot. When the request was refused, retry after that.
+	Reset time.Duration
+}
+
+// Lockout locks a key for Base once Threshold failures happen within Window.
+// Every further lockout within a day doubles the duration, up to Max.
+type Lockout struct {
+	Threshold int
+	Window    time.Duration
+	Base      time.Duration
+	Max       time.Duration
+}
+
+// duration is how long the given lockout, counting from 1, lasts.
+func (p Lockout) duration(strike int) time.Duration {
+	d := p.Base
+	for i := 1; i < strike && d < p.Max; i++ {
+		d *= 2
+	}
+	return min(d, p.Max)
+}
+
+type Limiter struct {
+	rdb    *redis.Client
+	local  *local
+	logger *slog.Logger
+}
+
+// New returns a Limiter storing its state in rdb. Redis errors are logged to
+// logger and answered from the in-process fallback.
+func New(rdb *redis.Client, logger *slog.Logger) *Limiter {
+	return &Limiter{rdb: rdb, local: newLocal(), logger: logger}
+}
+
+func (l *Limiter) fallback(op string, err error) {
+	l.logger.Warn("rate limiter falling back to local state", "op", op, "err", err)
+}
+
+// Allow records a request for key if rule still allows one, and reports how
+// much of the rule is left. Refused requests are not recorded.
+func (l *Limiter) Allow(ctx context.Context, key string, rule Rule, now time.Time) Decision {
+	d, err := l.allowRedis(ctx, key, rule, now)
+	if err != nil {
+		l.fallback("allow", err)
+		return l.local.allow(key, rule, now)
+	}
+	return d
+}
+
+// Locked reports how much longer key is locked out, or zero.
+func (l *Limiter) Locked(ctx context.Context, key string, now time.Time) time.Duration {
+	until, err := l.rdb.Get(ctx, keyPrefix+"lock:"+key).Int64()
+	if err == redis.Nil {
+		return l.local.locked(key, now)
+	}
+	if err != nil {
+		l.fallback("locked", err)
+		return l.local.locked(key, now)
+	}
+	return max(time.UnixMilli(until).Sub(now), 0)
+}
+
+// Fail counts a failure for key. When it reaches the policy's threshold the
+// key is locked and Fail returns for how long; otherwise it returns zero.
+func (l *Limiter) Fail(ctx context.Context, key string, p Lockout, now time.Time) time.Duration {
+	d, err := l.failRedis(ctx, key, p, now)
+	if err != nil {
+		l.fallback("fail", err)
+		return l.local.fail(key, p, now)
+	}
+	return d
+}
+
+// Reset forgets the failures of key, e.g. after a successful login. Past
+// lockouts still count towards the next one.
+func (l *Limiter) Reset(ctx context.Context, key string) {
+	l.local.reset(key)
+	if err := l.rdb.Del(ctx, keyPrefix+"fail:"+key).Err(); err != nil {
+		l.fallback("reset", err)
+	}
+}
+
+// allowScript keeps a sorted set of request timestamps per key.
+// Returns {allowed, count in window, oldest timestamp in window}.
+var allowScript = redis.NewScript(`
+local key, now, window, limit = KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', key, now, ARGV[4])
+	redis.call('PEXPIRE', key, window)
+	count = count + 1
+	allowed = 1
+end
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+return {allowed, count, tonumber(oldest[2])}
+`)
+
+func (l *Limiter) allowRedis(ctx context.Context, key string, rule Rule, now time.Time) (Decision, error) {
+	member, err := uniqueMember(now)
+	if err != nil {
+		return Decision{}, err
+	}
+	window := rule.Window.Milliseconds()
+	res, err := allowScript.Run(ctx, l.rdb, []string{keyPrefix + "hits:" + key},
+		now.UnixMilli(), window, rule.Limit, member).Int64Slice()
+	if err != nil {
+		return Decision{}, err
+	}
+	allowed, count, oldest := res[0] == 1, int(res[1]), res[2]
+	return Decision{
+		Allowed:   allowed,
+		Limit:     rule.Limit,
+		Remaining: rule.Limit - count,
+		Reset:     time.UnixMilli(oldest + window).Sub(now),
+	}, nil
+}
+
+// uniqueMember makes concurrent requests in the same millisecond, possibly on
+// different replicas, separate entries of the sorted set.
+func uniqueMember(now time.Time) (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(now.UnixNano(), 10) + "-" + hex.EncodeToString(b), nil
+}
+
+// failScript counts failures in a window starting at the first one. On
+// reaching the threshold it resets the count, bumps the strike counter and
+// stores the lockout's end time, in milliseconds, as the lock value.
+// Returns the lockout duration in milliseconds, or 0.
+var failScript = redis.NewScript(`
+local fail, lock, strikes = KEYS[1], KEYS[2], KEYS[3]
+local threshold, window, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local base, max, memory = tonumber(ARGV[4]), tonumber(ARGV[5]), tonumber(ARGV[6])
+local n = redis.call('INCR', fail)
+if n == 1 then
+	redis.call('PEXPIRE', fail, window)
+end
+if n < threshold then
+	return 0
+end
+redis.call('DEL', fail)
+local strike = redis.call('INCR', strikes)
+redis.call('PEXPIRE', strikes, memory)
+local d = base
+for i = 2, strike do
+	if d >= max then break end
+	d = d * 2
+end
+if d > max then d = max end
+redis.call('SET', lock, now + d, 'PX', d)
+return d
+`)
+
+func (l *Limiter) failRedis(ctx context.Context, key string, p Lockout, now time.Time) (time.Duration, error) {
+	ms, err := failScript.Run(ctx, l.rdb,
+		[]string{keyPrefix + "fail:" + key, keyPrefix + "lock:" + key, keyPrefix + "strikes:" + key},
+		p.Threshold, p.Window.Milliseconds(), now.UnixMilli(),
+		p.Base.Milliseconds(), p.Max.Milliseconds(), strikeMemory.Milliseconds()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
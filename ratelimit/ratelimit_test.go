@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// limiters returns a Limiter backed by Redis and one whose Redis is down, so
+// every test covers the fallback as well.
+func limiters(t *testing.T) map[string]*Limiter {
+	mr := miniredis.RunT(t)
+	up := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	down := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() {
+		up.Close()
+		down.Close()
+	})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return map[string]*Limiter{
+		"redis":    New(up, logger),
+		"fallback": New(down, logger),
+	}
+}
+
+func TestAllowSlidingWindow(t *testing.T) {
+	ctx := context.Background()
+	rule := Rule{Limit: 3, Window: time.Minute}
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for name, l := range limiters(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				d := l.Allow(ctx, "k", rule, start.Add(time.Duration(i)*10*time.Second))
+				if !d.Allowed || d.Remaining != 2-i {
+					t.Fatalf("request %d: expected allowed with %d remaining; got %+v", i, 2-i, d)
+				}
+			}
+
+			d := l.Allow(ctx, "k", rule, start.Add(30*time.Second))
+			if d.Allowed {
+				t.Fatal("expected the fourth request in the window to be refused")
+			}
+			if d.Reset != 30*time.Second {
+				t.Errorf("expected a slot to free up when the first request leaves the window; got %s", d.Reset)
+			}
+
+			// Other keys have their own window.
+			if !l.Allow(ctx, "other", rule, start.Add(30*time.Second)).Allowed {
+				t.Error("expected another key to be unaffected")
+			}
+
+			// The window slides: once the first request is a minute old there
+			// is room for exactly one more.
+			if !l.Allow(ctx, "k", rule, start.Add(time.Minute+time.Second)).Allowed {
+				t.Error("expected a request once the oldest one left the window")
+			}
+			if l.Allow(ctx, "k", rule, start.Add(time.Minute+2*time.Second)).Allowed {
+				t.Error("expected the window to be full again")
+			}
+		})
+	}
+}
+
+func TestLockout(t *testing.T) {
+	ctx := context.Background()
+	policy := Lockout{Threshold: 3, Window: 15 * time.Minute, Base: time.Minute, Max: 3 * time.Minute}
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for name, l := range limiters(t) {
+		t.Run(name, func(t *testing.T) {
+			// Each round of failures locks for longer: 1m, 2m, then capped at 3m.
+			for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+				for i := 1; i < policy.Threshold; i++ {
+					if d := l.Fail(ctx, "user", policy, now); d != 0 {
+						t.Fatalf("expected no lockout before the threshold; got %s", d)
+					}
+				}
+				if d := l.Fail(ctx, "user", policy, now); d != want {
+					t.Fatalf("expected a %s lockout; got %s", want, d)
+				}
+				if d := l.Locked(ctx, "user", now.Add(10*time.Second)); d != want-10*time.Second {
+					t.Errorf("expected %s left; got %s", want-10*time.Second, d)
+				}
+				now = now.Add(want)
+				if d := l.Locked(ctx, "user", now); d != 0 {
+					t.Errorf("expected the lockout to be over; got %s left", d)
+				}
+			}
+
+			// A success in between starts the count over.
+			l.Fail(ctx, "reset", policy, now)
+			l.Fail(ctx, "reset", policy, now)
+			l.Reset(ctx, "reset")
+			if d := l.Fail(ctx, "reset", policy, now); d != 0 {
+				t.Errorf("expected Reset to clear the failures; got a %s lockout", d)
+			}
+		})
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("20/1m")
+	if err != nil || rule != (Rule{Limit: 20, Window: time.Minute}) {
+		t.Errorf("expected 20 per minute; got %+v, %v", rule, err)
+	}
+	for _, bad := range []string{"20", "0/1m", "x/1m", "5/soon", "5/-1s"} {
+		if _, err := ParseRule(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Package recurrence reads a subset of iCalendar RRULEs (RFC 5545) and works
+// out the occurrences of the series they describe.
+//
+// Supported are FREQ (DAILY, WEEKLY, MONTHLY, YEARLY), INTERVAL, BYDAY for
+// weekly rules, BYMONTHDAY for monthly rules and UNTIL. Occurrences keep the
+// wall clock time of the series start in its location, so a todo due at 09:00
+// stays at 09:00 local time across daylight saving changes.
+package recurrence
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	// Rules are evaluated in IANA time zones, which the server image does
+	// not ship.
+	_ "time/tzdata"
+)
+
+type Freq string
+
+const (
+	Daily   Freq = "DAILY"
+	Weekly  Freq = "WEEKLY"
+	Monthly Freq = "MONTHLY"
+	Yearly  Freq = "YEARLY"
+)
+
+// maxPeriods bounds the search for the next occurrence, so a rule that can
+// never match again (BYMONTHDAY=31 with INTERVAL=12 on a 30-day month) ends.
+const maxPeriods = 100000
+
+var weekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// Rule is a parsed RRULE.
+type Rule struct {
+	Freq     Freq
+	Interval int
+	// ByDay are the weekdays of a weekly rule; empty means the weekday of
+	// the series start.
+	ByDay []time.Weekday
+	// ByMonthDay are the days of a monthly rule, negative ones counting from
+	// the end of the month; empty means the day of the series start.
+	ByMonthDay []int
+	// Until is the last moment an occurrence may fall on. With UntilDate it
+	// is a whole day in the location of the series instead.
+	Until     time.Time
+	UntilDate bool
+}
+
+// Parse reads a rule like "FREQ=WEEKLY;BYDAY=MO,WE" with an optional
+// "RRULE:" prefix.
+func Parse(s string) (Rule, error) {
+	r := Rule{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return r, fmt.Errorf("empty rule")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return r, fmt.Errorf("%q is not a KEY=VALUE pair", part)
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.Freq = Freq(strings.ToUpper(value))
+			switch r.Freq {
+			case Daily, Weekly, Monthly, Yearly:
+			default:
+				return r, fmt.Errorf("FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY, got %q", value)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 1000 {
+				return r, fmt.Errorf("INTERVAL must be between 1 and 1000, got %q", value)
+			}
+			r.Interval = n
+		case "BYDAY":
+			for _, day := range strings.Split(strings.ToUpper(value), ",") {
+				wd, ok := weekdays[day]
+				if !ok {
+					return r, fmt.Errorf("BYDAY must list days like MO,WE, got %q", day)
+				}
+				if !slices.Contains(r.ByDay, wd) {
+					r.ByDay = append(r.ByDay, wd)
+				}
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(day)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return r, fmt.Errorf("BYMONTHDAY must be between 1 and 31 or -31 and -1, got %q", day)
+				}
+				if !slices.Contains(r.ByMonthDay, n) {
+					r.ByMonthDay = append(r.ByMonthDay, n)
+				}
+			}
+		case "UNTIL":
+			if t, err := time.Parse("20060102T150405Z", value); err == nil {
+				r.Until = t
+			} else if t, err := time.Parse("20060102", value); err == nil {
+				r.Until, r.UntilDate = t, true
+			} else {
+				return r, fmt.Errorf("UNTIL must look like 20251231 or 20251231T235959Z, got %q", value)
+			}
+		default:
+			return r, fmt.Errorf("%s is not supported", strings.ToUpper(key))
+		}
+	}
+
+	switch {
+	case r.Freq == "":
+		return r, fmt.Errorf("FREQ is required")
+	case len(r.ByDay) > 0 && r.Freq != Weekly:
+		return r, fmt.Errorf("BYDAY is only supported with FREQ=WEEKLY")
+	case len(r.ByMonthDay) > 0 && r.Freq != Monthly:
+		return r, fmt.Errorf("BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	// Weeks start on Monday (the RRULE default), and so does the order here.
+	slices.SortFunc(r.ByDay, func(a, b time.Weekday) int { return mondayIndex(a) - mondayIndex(b) })
+	slices.Sort(r.ByMonthDay)
+	return r, nil
+}
+
+// String writes the rule back in a canonical form that Parse accepts.
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + string(r.Freq)}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, wd := range r.ByDay {
+			days[i] = strings.ToUpper(wd.String()[:2])
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, len(r.ByMonthDay))
+		for i, d := range r.ByMonthDay {
+			days[i] = strconv.Itoa(d)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	switch {
+	case r.UntilDate:
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	case !r.Until.IsZero():
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Next returns the first occurrence of the series starting at start that is
+// later than after, computed in start's location. ok is false once the series
+// has ended.
+func (r Rule) Next(start, after time.Time) (next time.Time, ok bool) {
+	interval := max(r.Interval, 1)
+	for period := 0; period < maxPeriods; period += interval {
+		for _, t := range r.occurrences(start, period) {
+			if !t.After(start) || !t.After(after) {
+				continue
+			}
+			if r.ended(t) {
+				return time.Time{}, false
+			}
+			return t, true
+		}
+		// The candidates of later periods are later still, so a period that
+		// starts past UNTIL ends the search.
+		if r.ended(wallClock(r.periodStart(start, period), start)) {
+			return time.Time{}, false
+		}
+	}
+	return time.Time{}, false
+}
+
+func (r Rule) ended(t time.Time) bool {
+	if r.Until.IsZero() {
+		return false
+	}
+	if r.UntilDate {
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).After(r.Until)
+	}
+	return t.After(r.Until)
+}
+
+// periodStart is the first day of the period'th day, week, month or year
+// counting from the one start falls in, as a calendar date.
+func (r Rule) periodStart(start time.Time, period int) time.Time {
+	day := calendarDay(start)
+	switch r.Freq {
+	case Weekly:
+		return day.AddDate(0, 0, period*7-mondayIndex(start.Weekday()))
+	case Monthly:
+		return time.Date(day.Year(), day.Month()+time.Month(period), 1, 0, 0, 0, 0, time.UTC)
+	case Yearly:
+		return time.Date(day.Year()+period, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day.AddDate(0, 0, period)
+}
+
+// occurrences returns the candidates of one period in order; some may lie
+// before start.
+func (r Rule) occurrences(start time.Time, period int) []time.Time {
+	first := r.periodStart(start, period)
+	switch r.Freq {
+	case Weekly:
+		days := r.ByDay
+		if len(days) == 0 {
+			days = []time.Weekday{start.Weekday()}
+		}
+		var out []time.Time
+		for _, wd := range days {
+			out = append(out, wallClock(first.AddDate(0, 0, mondayIndex(wd)), start))
+		}
+		return out
+
+	case Monthly:
+		length := daysIn(first.Year(), first.Month())
+		days := r.ByMonthDay
+		if len(days) == 0 {
+			days = []int{start.Day()}
+		}
+		var out []time.Time
+		for _, d := range days {
+			if d < 0 {
+				d += length + 1
+			}
+			// Months without the day are skipped, as RFC 5545 says.
+			if d >= 1 && d <= length {
+				out = append(out, wallClock(first.AddDate(0, 0, d-1), start))
+			}
+		}
+		slices.SortFunc(out, time.Time.Compare)
+		return out
+
+	case Yearly:
+		// Feb 29 only comes back in leap years.
+		if start.Day() > daysIn(first.Year(), start.Month()) {
+			return nil
+		}
+		return []time.Time{wallClock(time.Date(first.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC), start)}
+	}
+	return []time.Time{wallClock(first, start)}
+}
+
+// calendarDay is the date of t in its own location, as midnight UTC so
+// calendar arithmetic cannot trip over daylight saving changes.
+func calendarDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// wallClock puts the calendar date day at the wall clock time of start, in
+// start's location. A time that falls into a daylight saving gap is moved
+// forward by the length of the gap, so with a one hour gap at 02:00 02:30
+// becomes 03:30.
+func wallClock(day, start time.Time) time.Time {
+	t := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+	want := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+	if !calendarTime(t).Before(want) {
+		// Either the time exists or time.Date already moved it past the gap.
+		return t
+	}
+	// time.Date put the missing time at the offset from after the gap, which
+	// lands before it; shift by the gap to land after it instead.
+	_, before := t.Zone()
+	_, end := t.ZoneBounds()
+	_, after := end.Zone()
+	return t.Add(time.Duration(after-before) * time.Second)
+}
+
+// calendarTime is the wall clock time of t in its own location, as UTC.
+func calendarTime(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func mondayIndex(wd time.Weekday) int {
+	return (int(wd) + 6) % 7
+}
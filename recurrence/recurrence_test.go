@@ -0,0 +1,231 @@
+package recurrence
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, s string) Rule {
+	t.Helper()
+	r, err := Parse(s)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", s, err)
+	}
+	return r
+}
+
+// series returns the first n occurrences after start.
+func series(r Rule, start time.Time, n int) []time.Time {
+	var out []time.Time
+	after := start
+	for len(out) < n {
+		next, ok := r.Next(start, after)
+		if !ok {
+			break
+		}
+		out = append(out, next)
+		after = next
+	}
+	return out
+}
+
+func TestParse(t *testing.T) {
+	canonical := map[string]string{
+		"FREQ=DAILY":                            "FREQ=DAILY",
+		"RRULE:freq=weekly;byday=we,mo,we":      "FREQ=WEEKLY;BYDAY=MO,WE",
+		"FREQ=WEEKLY;INTERVAL=1":                "FREQ=WEEKLY",
+		"FREQ=MONTHLY;BYMONTHDAY=-1,15":         "FREQ=MONTHLY;BYMONTHDAY=-1,15",
+		"FREQ=YEARLY;INTERVAL=2;UNTIL=20301231": "FREQ=YEARLY;INTERVAL=2;UNTIL=20301231",
+		"FREQ=DAILY;UNTIL=20250601T120000Z":     "FREQ=DAILY;UNTIL=20250601T120000Z",
+	}
+	for in, want := range canonical {
+		if got := mustParse(t, in).String(); got != want {
+			t.Errorf("Parse(%q).String() = %q; want %q", in, got, want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"DAILY",
+		"INTERVAL=2",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;BYDAY=MO",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=MONTHLY;BYMONTHDAY=0",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=DAILY;UNTIL=tomorrow",
+		"FREQ=DAILY;COUNT=3",
+	} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("expected Parse(%q) to fail", in)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 9, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name  string
+		rule  string
+		start time.Time
+		want  []time.Time
+	}{
+		{
+			name:  "daily every other day",
+			rule:  "FREQ=DAILY;INTERVAL=2",
+			start: day(2025, 12, 30),
+			want:  []time.Time{day(2026, 1, 1), day(2026, 1, 3)},
+		},
+		{
+			// 2025-06-04 is a Wednesday, so Monday of that week is skipped.
+			name:  "weekly on given days",
+			rule:  "FREQ=WEEKLY;BYDAY=MO,WE,FR",
+			start: day(2025, 6, 4),
+			want:  []time.Time{day(2025, 6, 6), day(2025, 6, 9), day(2025, 6, 11)},
+		},
+		{
+			name:  "fortnightly",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU",
+			start: day(2025, 6, 4),
+			want:  []time.Time{day(2025, 6, 17), day(2025, 7, 1)},
+		},
+		{
+			name:  "monthly on the 31st skips short months",
+			rule:  "FREQ=MONTHLY",
+			start: day(2025, 1, 31),
+			want:  []time.Time{day(2025, 3, 31), day(2025, 5, 31), day(2025, 7, 31)},
+		},
+		{
+			name:  "monthly on the last day",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=-1",
+			start: day(2024, 1, 31),
+			want:  []time.Time{day(2024, 2, 29), day(2024, 3, 31), day(2024, 4, 30)},
+		},
+		{
+			name:  "yearly on Feb 29",
+			rule:  "FREQ=YEARLY",
+			start: day(2024, 2, 29),
+			want:  []time.Time{day(2028, 2, 29), day(2032, 2, 29)},
+		},
+		{
+			name:  "until a date",
+			rule:  "FREQ=DAILY;UNTIL=20250103",
+			start: day(2025, 1, 1),
+			want:  []time.Time{day(2025, 1, 2), day(2025, 1, 3)},
+		},
+		{
+			name:  "until a moment",
+			rule:  "FREQ=DAILY;UNTIL=20250103T080000Z",
+			start: day(2025, 1, 1),
+			want:  []time.Time{day(2025, 1, 2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := series(mustParse(t, tt.rule), tt.start, len(tt.want)+1)
+			// Only UNTIL ends a series; the others are cut off here.
+			if !strings.Contains(tt.rule, "UNTIL") {
+				got = got[:len(tt.want)]
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v; got %v", tt.want, got)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("occurrence %d: expected %s; got %s", i, tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNextSkipsMissedOccurrences(t *testing.T) {
+	r := mustParse(t, "FREQ=WEEKLY;BYDAY=MO")
+	start := time.Date(2025, 6, 2, 9, 0, 0, 0, time.UTC)
+
+	// Completed weeks late, the next occurrence is the first one still ahead
+	// and stays on the series' schedule.
+	next, ok := r.Next(start, time.Date(2025, 6, 25, 17, 0, 0, 0, time.UTC))
+	if want := time.Date(2025, 6, 30, 9, 0, 0, 0, time.UTC); !ok || !next.Equal(want) {
+		t.Errorf("expected %s; got %s (ok=%v)", want, next, ok)
+	}
+}
+
+func TestNextAcrossDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+
+	// 09:00 stays 09:00 on both sides of spring forward (2025-03-09) and
+	// fall back (2025-11-02), so the UTC time moves by an hour.
+	r := mustParse(t, "FREQ=DAILY")
+	for _, start := range []time.Time{
+		time.Date(2025, 3, 8, 9, 0, 0, 0, ny),
+		time.Date(2025, 11, 1, 9, 0, 0, 0, ny),
+	} {
+		for i, next := range series(r, start, 3) {
+			if next.Hour() != 9 || next.Minute() != 0 {
+				t.Errorf("occurrence %d after %s: expected 09:00 local; got %s", i, start, next)
+			}
+			if want := start.AddDate(0, 0, i+1); !next.Equal(want) {
+				t.Errorf("occurrence %d after %s: expected %s; got %s", i, start, want, next)
+			}
+		}
+	}
+
+	// 02:30 does not exist on 2025-03-09. That day's occurrence moves past
+	// the gap, and the day after is back at 02:30 rather than drifting.
+	start := time.Date(2025, 3, 8, 2, 30, 0, 0, ny)
+	got := series(r, start, 2)
+	want := []time.Time{
+		time.Date(2025, 3, 9, 3, 30, 0, 0, ny),
+		time.Date(2025, 3, 10, 2, 30, 0, 0, ny),
+	}
+	for i := range want {
+		if i >= len(got) || !got[i].Equal(want[i]) {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	}
+
+	// Go resolves Berlin's gap on 2025-03-30 differently from New York's, and
+	// 02:30 still lands at 03:30 local.
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	start = time.Date(2025, 3, 28, 2, 30, 0, 0, berlin)
+	got = series(r, start, 3)
+	want = []time.Time{
+		time.Date(2025, 3, 29, 2, 30, 0, 0, berlin),
+		time.Date(2025, 3, 30, 1, 30, 0, 0, time.UTC), // 03:30 CEST
+		time.Date(2025, 3, 31, 2, 30, 0, 0, berlin),
+	}
+	for i := range want {
+		if i >= len(got) || !got[i].Equal(want[i]) {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	}
+	if got[1].Hour() != 3 || got[1].Minute() != 30 {
+		t.Errorf("expected 03:30 local in the gap; got %s", got[1])
+	}
+
+	// 01:30 happens twice on 2025-11-02; the weekly series takes the first.
+	start = time.Date(2025, 10, 26, 1, 30, 0, 0, ny)
+	next, _ := mustParse(t, "FREQ=WEEKLY").Next(start, start)
+	if want := time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("expected %s; got %s", want, next.UTC())
+	}
+
+	// Occurrences are computed in the start's location, so a todo due late in
+	// the evening in New York repeats on its local weekday.
+	start = time.Date(2025, 6, 6, 22, 0, 0, 0, ny) // Friday
+	next, _ = mustParse(t, "FREQ=WEEKLY;BYDAY=FR").Next(start, start)
+	if next.Weekday() != time.Friday || next.UTC().Weekday() != time.Saturday {
+		t.Errorf("expected a Friday evening in New York; got %s", next)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"todo-api-v1/api"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis holds the hot copy of the revocation state so authMiddleware does not
+// hit Postgres on every request. Postgres stays the source of truth and is
+// used directly whenever Redis cannot answer.
+
+func revokedTokenKey(jti string) string {
+	return "revoked_jti:" + jti
+}
+
+func tokenVersionKey(userID int) string {
+	return fmt.Sprintf("token_version:%d", userID)
+}
+
+// revokeAccessToken blacklists a single access token until it expires. The
+// revocation must reach Redis too: while Redis answers, a missing key means
+// the token is still good, so a failed write is returned for the client to
+// retry rather than leaving the token usable.
+func (s *Server) revokeAccessToken(ctx context.Context, claims *api.Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	expiresAt := claims.ExpiresAt.Time
+	if err := s.store.RevokeToken(ctx, claims.ID, claims.UserID, expiresAt); err != nil {
+		return err
+	}
+
+	ttl := expiresAt.Sub(s.now())
+	if ttl <= 0 {
+		return nil
+	}
+	if err := s.rdb.Set(ctx, revokedTokenKey(claims.ID), 1, ttl).Err(); err != nil {
+		return fmt.Errorf("cache revoked token: %w", err)
+	}
+	return nil
+}
+
+// revokeAllTokens bumps the user's token version, which invalidates every
+// access and refresh token issued before now.
+func (s *Server) revokeAllTokens(ctx context.Context, userID int) error {
+	version, err := s.store.IncrementTokenVersion(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.rdb.Set(ctx, tokenVersionKey(userID), version, accessTokenTTL).Err(); err != nil {
+		// A stale cached version would keep old tokens alive, so drop it
+		// and let the next check go to Postgres.
+		s.log(ctx).Warn("failed to cache token version", "user_id", userID, "err", err)
+		s.rdb.Del(ctx, tokenVersionKey(userID))
+	}
+	return nil
+}
+
+// isTokenRevoked reports whether a validly signed token was logged out,
+// either on its own or through a logout everywhere.
+func (s *Server) isTokenRevoked(ctx context.Context, claims *api.Claims) (bool, error) {
+	revoked, err := s.isTokenRevokedCached(ctx, claims)
+	if err == nil {
+		return revoked, nil
+	}
+	s.log(ctx).Warn("redis revocation check failed, using the database", "err", err)
+
+	if claims.ID != "" {
+		revoked, err := s.store.IsTokenRevoked(ctx, claims.ID)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	version, err := s.store.GetTokenVersion(ctx, claims.UserID)
+	if err != nil {
+		return false, err
+	}
+	return claims.TokenVersion != version, nil
+}
+
+func (s *Server) isTokenRevokedCached(ctx context.Context, claims *api.Claims) (bool, error) {
+	if claims.ID != "" {
+		n, err := s.rdb.Exists(ctx, revokedTokenKey(claims.ID)).Result()
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+
+	key := tokenVersionKey(claims.UserID)
+	val, err := s.rdb.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		version, err := s.store.GetTokenVersion(ctx, claims.UserID)
+		if err != nil {
+			return false, err
+		}
+		// SetNX so we never overwrite a newer version written by a logout.
+		s.rdb.SetNX(ctx, key, version, accessTokenTTL)
+		return claims.TokenVersion != version, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	version, err := strconv.Atoi(val)
+	if err != nil {
+		return false, err
+	}
+	return claims.TokenVersion != version, nil
+}
+
+// warmRevocationCache copies unexpired revocations from Postgres into Redis,
+// so a restarted or flushed Redis does not resurrect logged out tokens.
+func (s *Server) warmRevocationCache(ctx context.Context) error {
+	tokens, err := s.store.ListRevokedTokens(ctx)
+	if err != nil {
+		return err
+	}
+	pipe := s.rdb.Pipeline()
+	for _, t := range tokens {
+		if ttl := t.ExpiresAt.Sub(s.now()); ttl > 0 {
+			pipe.Set(ctx, revokedTokenKey(t.JTI), 1, ttl)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	claims, ok := r.Context().Value(claimsKey).(*api.Claims)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+
+	// The refresh token is optional; when given, its whole family goes too.
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			s.writeError(w, r, errBadRequest("Invalid request body"))
+			return
+		}
+	}
+
+	if err := s.revokeAccessToken(ctx, claims); err != nil {
+		s.writeError(w, r, fmt.Errorf("revoke access token: %w", err))
+		return
+	}
+	if body.RefreshToken != "" {
+		if err := s.store.RevokeRefreshToken(ctx, claims.UserID, hashToken(body.RefreshToken)); err != nil {
+			s.writeError(w, r, fmt.Errorf("revoke refresh token: %w", err))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	claims, ok := r.Context().Value(claimsKey).(*api.Claims)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+
+	if err := s.revokeAllTokens(ctx, claims.UserID); err != nil {
+		s.writeError(w, r, fmt.Errorf("revoke all tokens: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
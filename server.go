@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"todo-api-v1/cache"
+	"todo-api-v1/idempotency"
+	"todo-api-v1/metrics"
+	"todo-api-v1/ratelimit"
+	"todo-api-v1/store"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config is what a Server is built from. Store, Redis and Signer are
+// required; the rest falls back to the real thing.
+type Config struct {
+	Store  store.Store
+	Redis  *redis.Client
+	Signer *Signer
+	Clock  func() time.Time // defaults to time.Now
+	Logger *slog.Logger     // defaults to slog.Default()
+	// RateLimits defaults to defaultRateLimits().
+	RateLimits *RateLimits
+	// IdempotencyTTL is how long responses to requests with an
+	// Idempotency-Key are replayed; defaults to idempotency.DefaultTTL.
+	IdempotencyTTL time.Duration
+}
+
+// Server holds every dependency the handlers need, so several configured
+// instances can live side by side, e.g. in tests.
+type Server struct {
+	store   store.Store
+	rdb     *redis.Client // revocation state
+	cache   *cache.Cache
+	signer  *Signer
+	now     func() time.Time
+	logger  *slog.Logger
+	metrics *metrics.Metrics
+	limiter *ratelimit.Limiter
+	limits  RateLimits
+
+	// comparePassword is bcrypt.CompareHashAndPassword, swapped in tests.
+	comparePassword func(hash, password []byte) error
+
+	idempotency *idempotency.Store
+
+	// ready turns false once shutdown begins, see serve.
+	ready atomic.Bool
+}
+
+func NewServer(cfg Config) *Server {
+	m := metrics.New()
+	if db, ok := cfg.Store.(interface{ DB() *sql.DB }); ok {
+		m.RegisterDB("todos", db.DB())
+	}
+
+	s := &Server{
+		store:   store.Instrument(cfg.Store, m.ObserveStore),
+		rdb:     cfg.Redis,
+		cache:   cache.New(cfg.Redis),
+		signer:  cfg.Signer,
+		now:     cfg.Clock,
+		logger:  cfg.Logger,
+		metrics: m,
+
+		comparePassword: bcrypt.CompareHashAndPassword,
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	s.limiter = ratelimit.New(cfg.Redis, s.logger)
+	s.idempotency = idempotency.New(cfg.Redis, cfg.IdempotencyTTL)
+	s.limits = defaultRateLimits()
+	if cfg.RateLimits != nil {
+		s.limits = *cfg.RateLimits
+	}
+	s.ready.Store(true)
+	return s
+}
+
+// Handler returns the routes of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/todos/", s.authMiddleware(s.userQuota(s.todoHandler)))
+	mux.HandleFunc("/tags/", s.authMiddleware(s.userQuota(s.tagHandler)))
+	mux.HandleFunc("/lists/", s.authMiddleware(s.userQuota(s.listHandler)))
+	mux.HandleFunc("/invites/", s.authMiddleware(s.userQuota(s.inviteHandler)))
+
+	mux.HandleFunc("/register", s.registerHandler)
+
+	mux.HandleFunc("/login", s.loginHandler)
+	mux.HandleFunc("/token/refresh", s.refreshHandler)
+	mux.HandleFunc("/logout", s.authMiddleware(s.logoutHandler))
+	mux.HandleFunc("/logout/all", s.authMiddleware(s.logoutAllHandler))
+	mux.HandleFunc("/livez", s.livezHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	// Kept for existing monitors; same as /livez.
+	mux.HandleFunc("/health", s.livezHandler)
+	mux.Handle("/metrics", s.metrics.Handler())
+	// Anything else gets a JSON 404 rather than the mux's plain text one.
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		s.writeError(w, r, errNotFound("No such endpoint"))
+	})
+
+	return s.logRequests(s.metrics.Middleware(mux))
+}
+
+func (s *Server) setReady(ready bool) {
+	s.ready.Store(ready)
+}
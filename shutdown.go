@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// shutdownConfig controls how serve winds down.
+type shutdownConfig struct {
+	// Delay is how long /readyz fails before we stop accepting connections,
+	// giving Kubernetes time to take the pod out of its Service endpoints.
+	Delay time.Duration
+	// Timeout bounds how long in-flight requests get to finish.
+	Timeout time.Duration
+}
+
+// shutdownConfigFromEnv reads SHUTDOWN_DELAY and SHUTDOWN_TIMEOUT, e.g. "5s".
+// Together they have to stay below the pod's terminationGracePeriodSeconds.
+func shutdownConfigFromEnv() (shutdownConfig, error) {
+	cfg := shutdownConfig{Delay: 5 * time.Second, Timeout: 20 * time.Second}
+	for name, dst := range map[string]*time.Duration{"SHUTDOWN_DELAY": &cfg.Delay, "SHUTDOWN_TIMEOUT": &cfg.Timeout} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return cfg, fmt.Errorf("%s must be a duration like 10s, got %q", name, v)
+			}
+			*dst = d
+		}
+	}
+	return cfg, nil
+}
+
+// serve runs httpServer on ln until ctx is cancelled, then shuts down
+// gracefully: srv reports not ready for cfg.Delay, after which the listener
+// closes and in-flight requests get up to cfg.Timeout to complete.
+func serve(ctx context.Context, httpServer *http.Server, ln net.Listener, srv *Server, cfg shutdownConfig) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- httpServer.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		// The server died on its own; nothing left to drain.
+		return err
+	case <-ctx.Done():
+	}
+
+	srv.logger.Info("shutting down: failing readiness, then draining", "delay", cfg.Delay, "timeout", cfg.Timeout)
+	srv.setReady(false)
+	time.Sleep(cfg.Delay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	if err := httpServer.Shutdown(drainCtx); err != nil {
+		// Drain timed out; cut the remaining connections.
+		httpServer.Close()
+		return fmt.Errorf("drain: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	srv.logger.Info("all connections drained")
+	return nil
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"todo-api-v1/api"
+)
+
+// Kinds of TodoOp.
+const (
+	OpCreate = "create"
+	OpPatch  = "patch"
+	OpDelete = "delete"
+)
+
+// ErrRolledBack is the result of an operation that did not fail itself but
+// was undone because another one in the same atomic batch did.
+var ErrRolledBack = errors.New("rolled back")
+
+// TodoOp is one operation of BatchTodos. OpCreate creates Todo; OpPatch
+// applies Patch; OpDelete deletes Patch.ID, checking Patch.IfVersion.
+type TodoOp struct {
+	Kind  string
+	Todo  api.Todo
+	Patch TodoPatch
+}
+
+// TodoOpResult is what one TodoOp did: the todo it created or patched, or
+// the error it failed with. Deletes leave Todo empty.
+type TodoOpResult struct {
+	Todo api.Todo
+	Err  error
+}
+
+// BatchTodos runs ops in order in one transaction. An atomic batch stops at
+// the first failing op and commits nothing; every other result is then
+// ErrRolledBack. Otherwise each op fails on its own and the rest are kept.
+// Ops fail with the errors of the single-todo methods, and the returned
+// error is only for the batch as a whole.
+func (s *SQLStore) BatchTodos(ctx context.Context, userID int, ops []TodoOp, atomic bool) ([]TodoOpResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]TodoOpResult, len(ops))
+	for i, op := range ops {
+		// A failed statement aborts a Postgres transaction, so every op
+		// gets a savepoint to go back to.
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_op"); err != nil {
+			return nil, err
+		}
+		var r TodoOpResult
+		switch op.Kind {
+		case OpCreate:
+			r.Todo, r.Err = s.createTodo(ctx, tx, userID, op.Todo)
+		case OpPatch:
+			r.Todo, r.Err = s.patchTodo(ctx, tx, userID, op.Patch)
+		case OpDelete:
+			r.Err = s.deleteTodo(ctx, tx, userID, op.Patch.ID, op.Patch.IfVersion)
+		default:
+			r.Err = fmt.Errorf("unknown batch operation %q", op.Kind)
+		}
+		results[i] = r
+		if r.Err != nil {
+			if atomic {
+				return rollBack(results, i), nil
+			}
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_op"); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_op"); err != nil {
+			return nil, err
+		}
+	}
+	return results, tx.Commit()
+}
+
+// rollBack marks every result but the failed one as ErrRolledBack.
+func rollBack(results []TodoOpResult, failed int) []TodoOpResult {
+	for i := range results {
+		if i != failed {
+			results[i] = TodoOpResult{Err: ErrRolledBack}
+		}
+	}
+	return results
+}
+
+func (m *Memory) BatchTodos(ctx context.Context, userID int, ops []TodoOp, atomic bool) ([]TodoOpResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var saved *memSnapshot
+	if atomic {
+		saved = m.snapshot()
+	}
+	results := make([]TodoOpResult, len(ops))
+	for i, op := range ops {
+		var r TodoOpResult
+		switch op.Kind {
+		case OpCreate:
+			r.Todo, r.Err = m.createTodo(userID, op.Todo)
+		case OpPatch:
+			r.Todo, r.Err = m.patchTodo(userID, op.Patch)
+		case OpDelete:
+			r.Err = m.deleteTodo(userID, op.Patch.ID, op.Patch.IfVersion)
+		default:
+			r.Err = fmt.Errorf("unknown batch operation %q", op.Kind)
+		}
+		results[i] = r
+		if r.Err != nil && atomic {
+			m.restore(saved)
+			return rollBack(results, i), nil
+		}
+	}
+	return results, nil
+}
+
+// memSnapshot is the part of a Memory that todo writes change.
+type memSnapshot struct {
+	todos                            map[int]*memTodo
+	tags                             map[int]*memTag
+	nextTodoID, nextSubID, nextTagID int
+}
+
+func (m *Memory) snapshot() *memSnapshot {
+	s := &memSnapshot{
+		todos:      make(map[int]*memTodo, len(m.todos)),
+		tags:       make(map[int]*memTag, len(m.tags)),
+		nextTodoID: m.nextTodoID,
+		nextSubID:  m.nextSubID,
+		nextTagID:  m.nextTagID,
+	}
+	for id, t := range m.todos {
+		c := *t
+		c.subtasks = make([]*api.Subtask, len(t.subtasks))
+		for i, st := range t.subtasks {
+			stc := *st
+			c.subtasks[i] = &stc
+		}
+		c.tagIDs = make(map[int]bool, len(t.tagIDs))
+		for tagID := range t.tagIDs {
+			c.tagIDs[tagID] = true
+		}
+		s.todos[id] = &c
+	}
+	for id, tag := range m.tags {
+		c := *tag
+		s.tags[id] = &c
+	}
+	return s
+}
+
+func (m *Memory) restore(s *memSnapshot) {
+	m.todos, m.tags = s.todos, s.tags
+	m.nextTodoID, m.nextSubID, m.nextTagID = s.nextTodoID, s.nextSubID, s.nextTagID
+}
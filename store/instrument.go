@@ -0,0 +1,311 @@
+package store
+
+import (
+	"context"
+	"time"
+	"todo-api-v1/api"
+)
+
+// ObserveFunc receives the duration and outcome of every store call.
+type ObserveFunc func(method string, d time.Duration, err error)
+
+// Instrument wraps st so every call is reported to observe, e.g. for metrics.
+func Instrument(st Store, observe ObserveFunc) Store {
+	return &instrumented{next: st, observe: observe}
+}
+
+type instrumented struct {
+	next    Store
+	observe ObserveFunc
+}
+
+func (s *instrumented) GetUserTodos(ctx context.Context, userID int, q TodoQuery) (api.TodoPage, error) {
+	start := time.Now()
+	v, err := s.next.GetUserTodos(ctx, userID, q)
+	s.observe("GetUserTodos", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) CreateUserTodo(ctx context.Context, userID int, t api.Todo) (api.Todo, error) {
+	start := time.Now()
+	v, err := s.next.CreateUserTodo(ctx, userID, t)
+	s.observe("CreateUserTodo", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) GetUserTodo(ctx context.Context, userID, id int) (api.Todo, error) {
+	start := time.Now()
+	v, err := s.next.GetUserTodo(ctx, userID, id)
+	s.observe("GetUserTodo", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) UpdateUserTodo(ctx context.Context, userID int, t api.Todo) (api.Todo, error) {
+	start := time.Now()
+	v, err := s.next.UpdateUserTodo(ctx, userID, t)
+	s.observe("UpdateUserTodo", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) PatchUserTodo(ctx context.Context, userID int, p TodoPatch) (api.Todo, error) {
+	start := time.Now()
+	v, err := s.next.PatchUserTodo(ctx, userID, p)
+	s.observe("PatchUserTodo", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) DeleteUserTodo(ctx context.Context, userID, id, version int) error {
+	start := time.Now()
+	err := s.next.DeleteUserTodo(ctx, userID, id, version)
+	s.observe("DeleteUserTodo", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) BatchTodos(ctx context.Context, userID int, ops []TodoOp, atomic bool) ([]TodoOpResult, error) {
+	start := time.Now()
+	v, err := s.next.BatchTodos(ctx, userID, ops, atomic)
+	s.observe("BatchTodos", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) GetSubtasks(ctx context.Context, userID, todoID int) ([]api.Subtask, error) {
+	start := time.Now()
+	v, err := s.next.GetSubtasks(ctx, userID, todoID)
+	s.observe("GetSubtasks", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) CreateSubtask(ctx context.Context, userID, todoID int, task string) (api.Subtask, error) {
+	start := time.Now()
+	v, err := s.next.CreateSubtask(ctx, userID, todoID, task)
+	s.observe("CreateSubtask", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) UpdateSubtask(ctx context.Context, userID int, st api.Subtask) (api.Subtask, error) {
+	start := time.Now()
+	v, err := s.next.UpdateSubtask(ctx, userID, st)
+	s.observe("UpdateSubtask", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) DeleteSubtask(ctx context.Context, userID, todoID, subtaskID int) error {
+	start := time.Now()
+	err := s.next.DeleteSubtask(ctx, userID, todoID, subtaskID)
+	s.observe("DeleteSubtask", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) ReorderSubtasks(ctx context.Context, userID, todoID int, ids []int) ([]api.Subtask, error) {
+	start := time.Now()
+	v, err := s.next.ReorderSubtasks(ctx, userID, todoID, ids)
+	s.observe("ReorderSubtasks", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) GetUserTags(ctx context.Context, userID int) ([]api.Tag, error) {
+	start := time.Now()
+	v, err := s.next.GetUserTags(ctx, userID)
+	s.observe("GetUserTags", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) CreateTag(ctx context.Context, userID int, name string) (api.Tag, error) {
+	start := time.Now()
+	v, err := s.next.CreateTag(ctx, userID, name)
+	s.observe("CreateTag", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) RenameTag(ctx context.Context, userID, tagID int, name string) (api.Tag, error) {
+	start := time.Now()
+	v, err := s.next.RenameTag(ctx, userID, tagID, name)
+	s.observe("RenameTag", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) DeleteTag(ctx context.Context, userID, tagID int) error {
+	start := time.Now()
+	err := s.next.DeleteTag(ctx, userID, tagID)
+	s.observe("DeleteTag", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) RestoreUserTodo(ctx context.Context, userID, id int) (api.Todo, error) {
+	start := time.Now()
+	v, err := s.next.RestoreUserTodo(ctx, userID, id)
+	s.observe("RestoreUserTodo", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) PurgeUserTodo(ctx context.Context, userID, id int) error {
+	start := time.Now()
+	err := s.next.PurgeUserTodo(ctx, userID, id)
+	s.observe("PurgeUserTodo", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) PurgeTrash(ctx context.Context, cutoff time.Time) (int, error) {
+	start := time.Now()
+	v, err := s.next.PurgeTrash(ctx, cutoff)
+	s.observe("PurgeTrash", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) CreateList(ctx context.Context, userID int, name string) (api.List, error) {
+	start := time.Now()
+	v, err := s.next.CreateList(ctx, userID, name)
+	s.observe("CreateList", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) GetUserLists(ctx context.Context, userID int) ([]api.List, error) {
+	start := time.Now()
+	v, err := s.next.GetUserLists(ctx, userID)
+	s.observe("GetUserLists", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) GetUserList(ctx context.Context, userID, listID int) (api.List, error) {
+	start := time.Now()
+	v, err := s.next.GetUserList(ctx, userID, listID)
+	s.observe("GetUserList", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) RenameList(ctx context.Context, userID, listID int, name string) (api.List, error) {
+	start := time.Now()
+	v, err := s.next.RenameList(ctx, userID, listID, name)
+	s.observe("RenameList", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) DeleteList(ctx context.Context, userID, listID int) ([]int, error) {
+	start := time.Now()
+	v, err := s.next.DeleteList(ctx, userID, listID)
+	s.observe("DeleteList", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) SetMemberRole(ctx context.Context, userID, listID, memberID int, role string) error {
+	start := time.Now()
+	err := s.next.SetMemberRole(ctx, userID, listID, memberID, role)
+	s.observe("SetMemberRole", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) RemoveMember(ctx context.Context, userID, listID, memberID int) error {
+	start := time.Now()
+	err := s.next.RemoveMember(ctx, userID, listID, memberID)
+	s.observe("RemoveMember", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) CreateInvite(ctx context.Context, userID, listID int, username, role string) (api.Invite, error) {
+	start := time.Now()
+	v, err := s.next.CreateInvite(ctx, userID, listID, username, role)
+	s.observe("CreateInvite", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) GetUserInvites(ctx context.Context, userID int) ([]api.Invite, error) {
+	start := time.Now()
+	v, err := s.next.GetUserInvites(ctx, userID)
+	s.observe("GetUserInvites", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) AcceptInvite(ctx context.Context, userID, inviteID int) (api.List, error) {
+	start := time.Now()
+	v, err := s.next.AcceptInvite(ctx, userID, inviteID)
+	s.observe("AcceptInvite", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) DeclineInvite(ctx context.Context, userID, inviteID int) error {
+	start := time.Now()
+	err := s.next.DeclineInvite(ctx, userID, inviteID)
+	s.observe("DeclineInvite", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) CreateUser(ctx context.Context, username, passwordHash string) (int, error) {
+	start := time.Now()
+	v, err := s.next.CreateUser(ctx, username, passwordHash)
+	s.observe("CreateUser", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) GetUserByUsername(ctx context.Context, username string) (*api.User, error) {
+	start := time.Now()
+	v, err := s.next.GetUserByUsername(ctx, username)
+	s.observe("GetUserByUsername", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) CreateRefreshToken(ctx context.Context, userID int, familyID, tokenHash string, expiresAt time.Time) error {
+	start := time.Now()
+	err := s.next.CreateRefreshToken(ctx, userID, familyID, tokenHash, expiresAt)
+	s.observe("CreateRefreshToken", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (int, error) {
+	start := time.Now()
+	v, err := s.next.RotateRefreshToken(ctx, oldHash, newHash, expiresAt)
+	s.observe("RotateRefreshToken", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) RevokeRefreshToken(ctx context.Context, userID int, tokenHash string) error {
+	start := time.Now()
+	err := s.next.RevokeRefreshToken(ctx, userID, tokenHash)
+	s.observe("RevokeRefreshToken", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) RevokeToken(ctx context.Context, jti string, userID int, expiresAt time.Time) error {
+	start := time.Now()
+	err := s.next.RevokeToken(ctx, jti, userID, expiresAt)
+	s.observe("RevokeToken", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	start := time.Now()
+	v, err := s.next.IsTokenRevoked(ctx, jti)
+	s.observe("IsTokenRevoked", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) ListRevokedTokens(ctx context.Context) ([]RevokedToken, error) {
+	start := time.Now()
+	v, err := s.next.ListRevokedTokens(ctx)
+	s.observe("ListRevokedTokens", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) GetTokenVersion(ctx context.Context, userID int) (int, error) {
+	start := time.Now()
+	v, err := s.next.GetTokenVersion(ctx, userID)
+	s.observe("GetTokenVersion", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) IncrementTokenVersion(ctx context.Context, userID int) (int, error) {
+	start := time.Now()
+	v, err := s.next.IncrementTokenVersion(ctx, userID)
+	s.observe("IncrementTokenVersion", time.Since(start), err)
+	return v, err
+}
+
+func (s *instrumented) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.next.Ping(ctx)
+	s.observe("Ping", time.Since(start), err)
+	return err
+}
+
+func (s *instrumented) Close() error {
+	return s.next.Close()
+}
@@ -0,0 +1,472 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"todo-api-v1/api"
+)
+
+// InboxName is the name every user's inbox list starts with.
+const InboxName = "Inbox"
+
+var (
+	// ErrNotMember is returned when a member operation names a user who is
+	// not on the list.
+	ErrNotMember = fmt.Errorf("not a member of the list: %w", ErrNotFound)
+	// ErrUnknownUser is returned when inviting a username nobody has.
+	ErrUnknownUser = fmt.Errorf("unknown user: %w", ErrNotFound)
+	// ErrInvalidRole is returned for a role that is not owner, editor or
+	// viewer.
+	ErrInvalidRole = errors.New("invalid role")
+
+	ErrLastOwner      = fmt.Errorf("a list needs at least one owner: %w", ErrConflict)
+	ErrInbox          = fmt.Errorf("the inbox cannot be shared or deleted: %w", ErrConflict)
+	ErrAlreadyMember  = fmt.Errorf("already a member of the list: %w", ErrConflict)
+	ErrAlreadyInvited = fmt.Errorf("already invited to the list: %w", ErrConflict)
+)
+
+// ValidRole reports whether role is one a list member can have.
+func ValidRole(role string) bool {
+	return role == api.RoleOwner || role == api.RoleEditor || role == api.RoleViewer
+}
+
+func hasRole(role string, roles ...string) bool {
+	for _, r := range roles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
+
+// canRead and canWrite are SQL conditions on a list_id column, true when the
+// user bound to param may read or change todos in that list. They replace the
+// plain "user_id = $n" filters todos had before lists.
+func canRead(param string) string {
+	return "list_id IN (SELECT list_id FROM list_members WHERE user_id = " + param + ")"
+}
+
+func canWrite(param string) string {
+	return "list_id IN (SELECT list_id FROM list_members WHERE user_id = " + param + " AND role IN ('owner', 'editor'))"
+}
+
+// notTrashed and trashed are the SQL conditions on todos in and out of the
+// trash. Every todo query but those of the trash itself needs notTrashed.
+const (
+	notTrashed = "deleted_at IS NULL"
+	trashed    = "deleted_at IS NOT NULL"
+)
+
+// membership returns the role of userID on listID and whether the list is an
+// inbox, or ErrNotFound if the user is not a member.
+func (s *SQLStore) membership(ctx context.Context, db dbtx, userID, listID int) (role string, inbox bool, err error) {
+	err = db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT m.role, l.inbox_of IS NOT NULL
+		 FROM list_members m JOIN lists l ON l.id = m.list_id
+		 WHERE m.list_id = $1 AND m.user_id = $2`),
+		listID, userID).Scan(&role, &inbox)
+	return role, inbox, notFound(err)
+}
+
+// requireRole fails with ErrNotFound for non-members and ErrForbidden for
+// members without one of roles.
+func (s *SQLStore) requireRole(ctx context.Context, db dbtx, userID, listID int, roles ...string) (inbox bool, err error) {
+	role, inbox, err := s.membership(ctx, db, userID, listID)
+	if err != nil {
+		return false, err
+	}
+	if !hasRole(role, roles...) {
+		return false, ErrForbidden
+	}
+	return inbox, nil
+}
+
+// todoAccessError explains why a write to a todo matched no row: the todo is
+// missing or invisible to the user, the user may only read it, or it is no
+// longer at ifVersion (when that is not 0).
+func (s *SQLStore) todoAccessError(ctx context.Context, db dbtx, userID, todoID, ifVersion int) error {
+	return s.accessError(ctx, db, notTrashed, userID, todoID, ifVersion)
+}
+
+// accessError is todoAccessError for todos matching cond, i.e. notTrashed
+// or trashed.
+func (s *SQLStore) accessError(ctx context.Context, db dbtx, cond string, userID, todoID, ifVersion int) error {
+	var role string
+	var version int
+	err := db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT m.role, t.version FROM todos t JOIN list_members m ON m.list_id = t.list_id AND m.user_id = $2
+		 WHERE t.id = $1 AND t.`+cond),
+		todoID, userID).Scan(&role, &version)
+	if err != nil {
+		return notFound(err)
+	}
+	if role == api.RoleViewer {
+		return ErrForbidden
+	}
+	if ifVersion != 0 && version != ifVersion {
+		return ErrVersionMismatch
+	}
+	return ErrNotFound
+}
+
+// inboxID returns the id of the user's inbox list.
+func (s *SQLStore) inboxID(ctx context.Context, db dbtx, userID int) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, s.dialect.rebind(`SELECT id FROM lists WHERE inbox_of = $1`), userID).Scan(&id)
+	return id, notFound(err)
+}
+
+const listColumns = "l.id, l.name, l.inbox_of IS NOT NULL, l.created_at, m.role"
+
+func scanList(row rowScanner) (api.List, error) {
+	var l api.List
+	if err := row.Scan(&l.ID, &l.Name, &l.Inbox, &l.CreatedAt, &l.Role); err != nil {
+		return api.List{}, notFound(err)
+	}
+	return l, nil
+}
+
+// CreateList creates a shared list with userID as its owner.
+func (s *SQLStore) CreateList(ctx context.Context, userID int, name string) (api.List, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return api.List{}, err
+	}
+	defer tx.Rollback()
+
+	l := api.List{Name: name, Role: api.RoleOwner, CreatedAt: now()}
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind(`INSERT INTO lists (name, created_at) VALUES ($1, $2) RETURNING id`),
+		name, l.CreatedAt).Scan(&l.ID); err != nil {
+		return api.List{}, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, $3)`),
+		l.ID, userID, api.RoleOwner); err != nil {
+		return api.List{}, err
+	}
+	return l, tx.Commit()
+}
+
+// GetUserLists returns every list the user is a member of, inbox first.
+func (s *SQLStore) GetUserLists(ctx context.Context, userID int) ([]api.List, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT `+listColumns+` FROM lists l JOIN list_members m ON m.list_id = l.id
+		 WHERE m.user_id = $1 ORDER BY l.inbox_of IS NULL, l.id`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []api.List{}
+	for rows.Next() {
+		l, err := scanList(rows)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	return lists, rows.Err()
+}
+
+// GetUserList returns a list the user is a member of, with all its members.
+func (s *SQLStore) GetUserList(ctx context.Context, userID, listID int) (api.List, error) {
+	l, err := scanList(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT `+listColumns+` FROM lists l JOIN list_members m ON m.list_id = l.id
+		 WHERE l.id = $1 AND m.user_id = $2`), listID, userID))
+	if err != nil {
+		return api.List{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT m.user_id, u.username, m.role FROM list_members m JOIN users u ON u.id = m.user_id
+		 WHERE m.list_id = $1 ORDER BY m.user_id`), listID)
+	if err != nil {
+		return api.List{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m api.Member
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role); err != nil {
+			return api.List{}, err
+		}
+		l.Members = append(l.Members, m)
+	}
+	return l, rows.Err()
+}
+
+// RenameList changes the name of a list. Only owners may.
+func (s *SQLStore) RenameList(ctx context.Context, userID, listID int, name string) (api.List, error) {
+	if _, err := s.requireRole(ctx, s.db, userID, listID, api.RoleOwner); err != nil {
+		return api.List{}, err
+	}
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE lists SET name = $1 WHERE id = $2`), name, listID); err != nil {
+		return api.List{}, err
+	}
+	return s.GetUserList(ctx, userID, listID)
+}
+
+// DeleteList deletes a list with all its todos and returns who its members
+// were. Only owners may, and inboxes cannot be deleted.
+func (s *SQLStore) DeleteList(ctx context.Context, userID, listID int) ([]int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// With the list locked nobody can join it before it is gone, so the
+	// members read here are all there will be.
+	var id int
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT id FROM lists WHERE id = $1`+s.dialect.forUpdate),
+		listID).Scan(&id); err != nil {
+		return nil, notFound(err)
+	}
+	inbox, err := s.requireRole(ctx, tx, userID, listID, api.RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	if inbox {
+		return nil, ErrInbox
+	}
+	members, err := s.lockMembers(ctx, tx, listID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM lists WHERE id = $1`), listID); err != nil {
+		return nil, err
+	}
+	return memberIDs(members), tx.Commit()
+}
+
+// memberIDs returns the user IDs of members in ascending order.
+func memberIDs(members map[int]string) []int {
+	ids := make([]int, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// lockMembers returns the roles on a list by user, locking them for the rest
+// of tx so owner counts cannot change underneath.
+func (s *SQLStore) lockMembers(ctx context.Context, tx *sql.Tx, listID int) (map[int]string, error) {
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(
+		`SELECT user_id, role FROM list_members WHERE list_id = $1`+s.dialect.forUpdate), listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := map[int]string{}
+	for rows.Next() {
+		var id int
+		var role string
+		if err := rows.Scan(&id, &role); err != nil {
+			return nil, err
+		}
+		members[id] = role
+	}
+	return members, rows.Err()
+}
+
+// checkMemberChange applies the rules shared by both backends to changing
+// memberID's role to role, or removing them when role is empty.
+func checkMemberChange(members map[int]string, userID, memberID int, role string) error {
+	callerRole, ok := members[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if callerRole != api.RoleOwner && !(role == "" && userID == memberID) {
+		// Anybody may leave, only owners manage others.
+		return ErrForbidden
+	}
+	current, ok := members[memberID]
+	if !ok {
+		return ErrNotMember
+	}
+	if current == api.RoleOwner && role != api.RoleOwner {
+		owners := 0
+		for _, r := range members {
+			if r == api.RoleOwner {
+				owners++
+			}
+		}
+		if owners == 1 {
+			return ErrLastOwner
+		}
+	}
+	return nil
+}
+
+// SetMemberRole changes the role of a member. Only owners may, and the last
+// owner cannot step down.
+func (s *SQLStore) SetMemberRole(ctx context.Context, userID, listID, memberID int, role string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("%w %q", ErrInvalidRole, role)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	members, err := s.lockMembers(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+	if err := checkMemberChange(members, userID, memberID, role); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE list_members SET role = $3 WHERE list_id = $1 AND user_id = $2`),
+		listID, memberID, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMember takes memberID off the list. Owners may remove anybody, other
+// members only themselves; the last owner cannot leave.
+func (s *SQLStore) RemoveMember(ctx context.Context, userID, listID, memberID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	members, err := s.lockMembers(ctx, tx, listID)
+	if err != nil {
+		return err
+	}
+	if err := checkMemberChange(members, userID, memberID, ""); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM list_members WHERE list_id = $1 AND user_id = $2`),
+		listID, memberID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const inviteQuery = `SELECT i.id, i.list_id, l.name, u.username, i.role, b.username, i.created_at
+	FROM list_invites i
+	JOIN lists l ON l.id = i.list_id
+	JOIN users u ON u.id = i.user_id
+	JOIN users b ON b.id = i.invited_by`
+
+func scanInvite(row rowScanner) (api.Invite, error) {
+	var i api.Invite
+	err := row.Scan(&i.ID, &i.ListID, &i.ListName, &i.Username, &i.Role, &i.InvitedBy, &i.CreatedAt)
+	return i, notFound(err)
+}
+
+// CreateInvite offers username a role on a list. Only owners may invite, and
+// inboxes cannot be shared.
+func (s *SQLStore) CreateInvite(ctx context.Context, userID, listID int, username, role string) (api.Invite, error) {
+	if !ValidRole(role) {
+		return api.Invite{}, fmt.Errorf("%w %q", ErrInvalidRole, role)
+	}
+	inbox, err := s.requireRole(ctx, s.db, userID, listID, api.RoleOwner)
+	if err != nil {
+		return api.Invite{}, err
+	}
+	if inbox {
+		return api.Invite{}, ErrInbox
+	}
+
+	var inviteeID int
+	err = s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT id FROM users WHERE lower(username) = lower($1)`), username).Scan(&inviteeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return api.Invite{}, ErrUnknownUser
+	}
+	if err != nil {
+		return api.Invite{}, err
+	}
+	if _, _, err := s.membership(ctx, s.db, inviteeID, listID); err == nil {
+		return api.Invite{}, ErrAlreadyMember
+	} else if !errors.Is(err, ErrNotFound) {
+		return api.Invite{}, err
+	}
+
+	var id int
+	err = s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`INSERT INTO list_invites (list_id, user_id, role, invited_by, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`),
+		listID, inviteeID, role, userID, now()).Scan(&id)
+	if err != nil {
+		if err = conflict(err); errors.Is(err, ErrConflict) {
+			return api.Invite{}, ErrAlreadyInvited
+		}
+		return api.Invite{}, err
+	}
+	return scanInvite(s.db.QueryRowContext(ctx, s.dialect.rebind(inviteQuery+` WHERE i.id = $1`), id))
+}
+
+// GetUserInvites returns the invites waiting for the user.
+func (s *SQLStore) GetUserInvites(ctx context.Context, userID int) ([]api.Invite, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(inviteQuery+` WHERE i.user_id = $1 ORDER BY i.id`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []api.Invite{}
+	for rows.Next() {
+		i, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// AcceptInvite makes the user a member of the invite's list with the offered
+// role and returns the list.
+func (s *SQLStore) AcceptInvite(ctx context.Context, userID, inviteID int) (api.List, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return api.List{}, err
+	}
+	defer tx.Rollback()
+
+	var listID int
+	var role string
+	err = tx.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT list_id, role FROM list_invites WHERE id = $1 AND user_id = $2`+s.dialect.forUpdate),
+		inviteID, userID).Scan(&listID, &role)
+	if err != nil {
+		return api.List{}, notFound(err)
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM list_invites WHERE id = $1`), inviteID); err != nil {
+		return api.List{}, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, $3)`),
+		listID, userID, role); err != nil {
+		if err = conflict(err); errors.Is(err, ErrConflict) {
+			return api.List{}, ErrAlreadyMember
+		}
+		return api.List{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return api.List{}, err
+	}
+	return s.GetUserList(ctx, userID, listID)
+}
+
+// DeclineInvite drops an invite addressed to the user.
+func (s *SQLStore) DeclineInvite(ctx context.Context, userID, inviteID int) error {
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM list_invites WHERE id = $1 AND user_id = $2`), inviteID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,1091 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"todo-api-v1/api"
+)
+
+// Memory is a Store kept in process memory. It is meant for tests and quick
+// local runs; nothing survives a restart.
+type Memory struct {
+	mu sync.Mutex
+
+	nextUserID   int
+	nextTodoID   int
+	nextListID   int
+	nextInviteID int
+	nextSubID    int
+	nextTagID    int
+	users        map[int]*api.User
+	todos        map[int]*memTodo
+	lists        map[int]*memList
+	invites      map[int]*memInvite
+	tags         map[int]*memTag
+	refresh      map[string]*memRefreshToken // by token hash
+	revoked      map[string]RevokedToken     // by jti
+}
+
+type memTodo struct {
+	api.Todo
+	userID   int            // who created it
+	subtasks []*api.Subtask // in order
+	tagIDs   map[int]bool   // of every member
+	// recurrenceStart is the first due date of a recurring todo's series.
+	recurrenceStart *time.Time
+}
+
+type memTag struct {
+	api.Tag
+	userID int
+}
+
+type memList struct {
+	id        int
+	name      string
+	inboxOf   int // 0 for shared lists
+	createdAt time.Time
+	members   map[int]string // role by user ID
+}
+
+type memInvite struct {
+	id        int
+	listID    int
+	userID    int
+	role      string
+	invitedBy int
+	createdAt time.Time
+}
+
+type memRefreshToken struct {
+	userID    int
+	familyID  string
+	expiresAt time.Time
+	used      bool
+	revoked   bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:   map[int]*api.User{},
+		todos:   map[int]*memTodo{},
+		lists:   map[int]*memList{},
+		invites: map[int]*memInvite{},
+		tags:    map[int]*memTag{},
+		refresh: map[string]*memRefreshToken{},
+		revoked: map[string]RevokedToken{},
+	}
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// compareTodos orders a and b the way the SQL backends do for sortBy: by the
+// sort field, todos without a due date last, and by id to break ties.
+func compareTodos(sortBy string, a, b api.Todo) int {
+	desc := strings.HasPrefix(sortBy, "-")
+	c := 0
+	switch strings.TrimPrefix(sortBy, "-") {
+	case SortTask:
+		c = strings.Compare(a.Task, b.Task)
+	case SortPriority:
+		c = a.Priority - b.Priority
+	case SortDue:
+		switch {
+		case a.DueAt == nil && b.DueAt == nil:
+		case a.DueAt == nil:
+			return 1
+		case b.DueAt == nil:
+			return -1
+		default:
+			c = a.DueAt.Compare(*b.DueAt)
+		}
+	}
+	if c == 0 {
+		c = a.ID - b.ID
+	}
+	if desc {
+		return -c
+	}
+	return c
+}
+
+func (m *Memory) GetUserTodos(ctx context.Context, userID int, q TodoQuery) (api.TodoPage, error) {
+	q, err := q.normalize()
+	if err != nil {
+		return api.TodoPage{}, err
+	}
+
+	var after *api.Todo
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return api.TodoPage{}, err
+		}
+		after = &api.Todo{ID: c.ID, Task: c.Task, Priority: c.Priority, DueAt: c.Due}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	search := strings.ToLower(q.Search)
+	todos := []api.Todo{}
+	for _, t := range m.todos {
+		if _, ok := m.role(userID, t.ListID); !ok {
+			continue
+		}
+		if (t.DeletedAt != nil) != q.Trashed {
+			continue
+		}
+		if q.ListID != 0 && t.ListID != q.ListID {
+			continue
+		}
+		if q.Completed != nil && t.Completed != *q.Completed {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(t.Task), search) {
+			continue
+		}
+		if !matchesDue(t.Todo, q) {
+			continue
+		}
+		view := m.todoView(userID, t)
+		if !matchesTags(view.Tags, q) {
+			continue
+		}
+		if after != nil && compareTodos(q.Sort, t.Todo, *after) <= 0 {
+			continue
+		}
+		todos = append(todos, view)
+	}
+
+	sort.Slice(todos, func(i, j int) bool { return compareTodos(q.Sort, todos[i], todos[j]) < 0 })
+	if len(todos) > q.Limit+1 {
+		todos = todos[:q.Limit+1]
+	}
+	return q.page(todos), nil
+}
+
+// matchesTags reports whether a todo with tags passes the tag filter of q.
+func matchesTags(tags []string, q TodoQuery) bool {
+	if len(q.Tags) == 0 {
+		return true
+	}
+	matched := 0
+	for _, name := range q.Tags {
+		for _, tag := range tags {
+			if tag == name {
+				matched++
+			}
+		}
+	}
+	if q.AnyTag {
+		return matched > 0
+	}
+	return matched == len(q.Tags)
+}
+
+func matchesDue(t api.Todo, q TodoQuery) bool {
+	if q.Due != "" || q.DueAfter != nil || q.DueBefore != nil {
+		if t.DueAt == nil {
+			return false
+		}
+	}
+	switch q.Due {
+	case DueOverdue:
+		if t.Completed || !t.DueAt.Before(q.Now) {
+			return false
+		}
+	case DueWeek:
+		if t.Completed || t.DueAt.Before(q.Now) || !t.DueAt.Before(q.Now.Add(7*24*time.Hour)) {
+			return false
+		}
+	}
+	if q.DueAfter != nil && t.DueAt.Before(*q.DueAfter) {
+		return false
+	}
+	if q.DueBefore != nil && !t.DueAt.Before(*q.DueBefore) {
+		return false
+	}
+	return true
+}
+
+func (m *Memory) CreateUserTodo(ctx context.Context, userID int, t api.Todo) (api.Todo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.createTodo(userID, t)
+}
+
+func (m *Memory) createTodo(userID int, t api.Todo) (api.Todo, error) {
+	if _, ok := m.users[userID]; !ok {
+		return api.Todo{}, fmt.Errorf("user %d does not exist", userID)
+	}
+	if t.ListID == 0 {
+		t.ListID = m.inbox(userID).id
+	} else if _, err := m.requireRole(userID, t.ListID, api.RoleOwner, api.RoleEditor); err != nil {
+		return api.Todo{}, err
+	}
+
+	m.nextTodoID++
+	ts := now()
+	t.ID = m.nextTodoID
+	t.DueAt = utc(t.DueAt)
+	t.CreatedAt, t.UpdatedAt = ts, ts
+	t.CompletedAt = nil
+	if t.Completed {
+		t.CompletedAt = &ts
+	}
+	t.Progress = api.Progress{}
+	t.Version = 1
+	t.DeletedAt = nil
+	stored := &memTodo{Todo: t, userID: userID, tagIDs: map[int]bool{}}
+	if t.Recurrence != "" {
+		stored.recurrenceStart = t.DueAt
+	}
+	m.setTags(userID, stored, t.Tags)
+	m.todos[t.ID] = stored
+	return m.todoView(userID, stored), nil
+}
+
+func (m *Memory) GetUserTodo(ctx context.Context, userID, id int) (api.Todo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.todos[id]
+	if !ok || t.DeletedAt != nil {
+		return api.Todo{}, ErrNotFound
+	}
+	if _, ok := m.role(userID, t.ListID); !ok {
+		return api.Todo{}, ErrNotFound
+	}
+	return m.todoView(userID, t), nil
+}
+
+func (m *Memory) UpdateUserTodo(ctx context.Context, userID int, t api.Todo) (api.Todo, error) {
+	return m.PatchUserTodo(ctx, userID, ReplaceTodo(t))
+}
+
+func (m *Memory) PatchUserTodo(ctx context.Context, userID int, p TodoPatch) (api.Todo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.patchTodo(userID, p)
+}
+
+func (m *Memory) patchTodo(userID int, p TodoPatch) (api.Todo, error) {
+	stored, err := m.writableTodo(userID, p.ID)
+	if err != nil {
+		return api.Todo{}, err
+	}
+	if p.IfVersion != 0 && stored.Version != p.IfVersion {
+		return api.Todo{}, ErrVersionMismatch
+	}
+	if p.ListID != nil {
+		if _, err := m.requireRole(userID, *p.ListID, api.RoleOwner, api.RoleEditor); err != nil {
+			return api.Todo{}, err
+		}
+		stored.ListID = *p.ListID
+	}
+
+	ts := now()
+	wasCompleted := stored.Completed
+	dueAt, recurrence, timezone := stored.DueAt, stored.Recurrence, stored.Timezone
+	if p.SetDueAt {
+		dueAt = utc(p.DueAt)
+	}
+	if p.Recurrence != nil {
+		recurrence = *p.Recurrence
+	}
+	if p.Timezone != nil {
+		timezone = *p.Timezone
+	}
+	// The series keeps its start unless the schedule itself changes.
+	switch {
+	case recurrence == "":
+		stored.recurrenceStart = nil
+	case recurrence != stored.Recurrence || timezone != stored.Timezone || !sameTime(dueAt, stored.DueAt):
+		stored.recurrenceStart = dueAt
+	}
+	stored.DueAt, stored.Recurrence, stored.Timezone = dueAt, recurrence, timezone
+	if p.Task != nil {
+		stored.Task = *p.Task
+	}
+	if p.Priority != nil {
+		stored.Priority = *p.Priority
+	}
+	if p.Completed != nil {
+		switch {
+		case !*p.Completed:
+			stored.CompletedAt = nil
+		case !stored.Completed:
+			stored.CompletedAt = &ts
+		}
+		stored.Completed = *p.Completed
+		if stored.Completed {
+			for _, st := range stored.subtasks {
+				if !st.Completed {
+					st.Completed, st.CompletedAt = true, &ts
+				}
+			}
+			stored.Progress.Done = stored.Progress.Total
+		}
+	}
+	stored.UpdatedAt = ts
+	stored.Version++
+	if p.Tags != nil {
+		m.setTags(userID, stored, p.Tags)
+	}
+	if !wasCompleted && stored.Completed && stored.Recurrence != "" {
+		if err := m.createNextOccurrence(stored, ts); err != nil {
+			return api.Todo{}, err
+		}
+	}
+	return m.todoView(userID, stored), nil
+}
+
+// createNextOccurrence mirrors SQLStore.createNextOccurrence.
+func (m *Memory) createNextOccurrence(t *memTodo, ts time.Time) error {
+	start := t.recurrenceStart
+	if start == nil {
+		start = t.DueAt
+	}
+	if start != nil {
+		due, ok, err := nextDue(t.Todo, *start, ts)
+		if err != nil {
+			return err
+		}
+		if ok {
+			m.nextTodoID++
+			next := &memTodo{Todo: t.Todo, userID: t.userID, tagIDs: map[int]bool{}, recurrenceStart: start}
+			next.ID = m.nextTodoID
+			next.Completed, next.CompletedAt = false, nil
+			next.DueAt = &due
+			next.CreatedAt, next.UpdatedAt = ts, ts
+			for id := range t.tagIDs {
+				next.tagIDs[id] = true
+			}
+			for _, st := range t.subtasks {
+				m.nextSubID++
+				next.subtasks = append(next.subtasks, &api.Subtask{
+					ID: m.nextSubID, TodoID: next.ID, Task: st.Task, Position: st.Position, CreatedAt: ts,
+				})
+			}
+			next.syncSubtasks()
+			next.Version = 1
+			m.todos[next.ID] = next
+		}
+	}
+	t.Recurrence, t.Timezone, t.recurrenceStart = "", "", nil
+	return nil
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func (m *Memory) DeleteUserTodo(ctx context.Context, userID, id, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteTodo(userID, id, version)
+}
+
+func (m *Memory) deleteTodo(userID, id, version int) error {
+	t, err := m.writableTodo(userID, id)
+	if err != nil {
+		return err
+	}
+	if version != 0 && t.Version != version {
+		return ErrVersionMismatch
+	}
+	ts := now()
+	t.DeletedAt = &ts
+	t.Version++
+	return nil
+}
+
+// writableTodo returns a todo the user may change, with the same errors the
+// SQL backends return. Trashed todos are left out.
+func (m *Memory) writableTodo(userID, id int) (*memTodo, error) {
+	return m.editableTodo(userID, id, false)
+}
+
+// editableTodo is writableTodo for todos in the trash (inTrash) or out of it.
+func (m *Memory) editableTodo(userID, id int, inTrash bool) (*memTodo, error) {
+	t, ok := m.todos[id]
+	if !ok || (t.DeletedAt != nil) != inTrash {
+		return nil, ErrNotFound
+	}
+	role, ok := m.role(userID, t.ListID)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if role == api.RoleViewer {
+		return nil, ErrForbidden
+	}
+	return t, nil
+}
+
+func (m *Memory) GetSubtasks(ctx context.Context, userID, todoID int) ([]api.Subtask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.todos[todoID]
+	if !ok || t.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	if _, ok := m.role(userID, t.ListID); !ok {
+		return nil, ErrNotFound
+	}
+	return t.subtaskViews(), nil
+}
+
+func (m *Memory) CreateSubtask(ctx context.Context, userID, todoID int, task string) (api.Subtask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.writableTodo(userID, todoID)
+	if err != nil {
+		return api.Subtask{}, err
+	}
+	m.nextSubID++
+	st := &api.Subtask{ID: m.nextSubID, TodoID: todoID, Task: task, Position: len(t.subtasks) + 1, CreatedAt: now()}
+	t.subtasks = append(t.subtasks, st)
+	if err := m.subtasksChanged(t); err != nil {
+		return api.Subtask{}, err
+	}
+	return *st, nil
+}
+
+func (m *Memory) UpdateSubtask(ctx context.Context, userID int, st api.Subtask) (api.Subtask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.writableTodo(userID, st.TodoID)
+	if err != nil {
+		return api.Subtask{}, err
+	}
+	stored := t.subtask(st.ID)
+	if stored == nil {
+		return api.Subtask{}, ErrNotFound
+	}
+	switch {
+	case !st.Completed:
+		stored.CompletedAt = nil
+	case !stored.Completed:
+		ts := now()
+		stored.CompletedAt = &ts
+	}
+	stored.Task = st.Task
+	stored.Completed = st.Completed
+	if err := m.subtasksChanged(t); err != nil {
+		return api.Subtask{}, err
+	}
+	return *stored, nil
+}
+
+func (m *Memory) DeleteSubtask(ctx context.Context, userID, todoID, subtaskID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.writableTodo(userID, todoID)
+	if err != nil {
+		return err
+	}
+	stored := t.subtask(subtaskID)
+	if stored == nil {
+		return ErrNotFound
+	}
+	t.subtasks = append(t.subtasks[:stored.Position-1], t.subtasks[stored.Position:]...)
+	for i, st := range t.subtasks {
+		st.Position = i + 1
+	}
+	return m.subtasksChanged(t)
+}
+
+func (m *Memory) ReorderSubtasks(ctx context.Context, userID, todoID int, ids []int) ([]api.Subtask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.writableTodo(userID, todoID)
+	if err != nil {
+		return nil, err
+	}
+	if !sameSubtasks(t.subtaskViews(), ids) {
+		return nil, ErrSubtaskOrder
+	}
+	reordered := make([]*api.Subtask, len(ids))
+	for i, id := range ids {
+		reordered[i] = t.subtask(id)
+		reordered[i].Position = i + 1
+	}
+	t.subtasks = reordered
+	if err := m.subtasksChanged(t); err != nil {
+		return nil, err
+	}
+	return t.subtaskViews(), nil
+}
+
+func (t *memTodo) subtask(id int) *api.Subtask {
+	for _, st := range t.subtasks {
+		if st.ID == id {
+			return st
+		}
+	}
+	return nil
+}
+
+func (t *memTodo) subtaskViews() []api.Subtask {
+	views := make([]api.Subtask, len(t.subtasks))
+	for i, st := range t.subtasks {
+		views[i] = *st
+	}
+	return views
+}
+
+// subtasksChanged syncs t with its subtasks and, like editSubtasks, continues
+// the series of a recurring todo that its subtasks just completed.
+func (m *Memory) subtasksChanged(t *memTodo) error {
+	wasCompleted := t.Completed
+	t.syncSubtasks()
+	if !wasCompleted && t.Completed && t.Recurrence != "" {
+		return m.createNextOccurrence(t, *t.CompletedAt)
+	}
+	return nil
+}
+
+// syncSubtasks applies the same progress and completion rules as the SQL
+// backends after a subtask changed.
+func (t *memTodo) syncSubtasks() {
+	ts := now()
+	t.Version++
+	t.Progress = api.Progress{Total: len(t.subtasks)}
+	for _, st := range t.subtasks {
+		if st.Completed {
+			t.Progress.Done++
+		}
+	}
+	t.UpdatedAt = ts
+	if t.Progress.Total == 0 {
+		return
+	}
+	done := t.Progress.Done == t.Progress.Total
+	switch {
+	case !done:
+		t.CompletedAt = nil
+	case !t.Completed:
+		t.CompletedAt = &ts
+	}
+	t.Completed = done
+}
+
+// todoView is the todo as userID sees it, with their tags only.
+func (m *Memory) todoView(userID int, t *memTodo) api.Todo {
+	view := t.Todo
+	view.Tags = []string{}
+	for id := range t.tagIDs {
+		if tag := m.tags[id]; tag.userID == userID {
+			view.Tags = append(view.Tags, tag.Name)
+		}
+	}
+	sort.Strings(view.Tags)
+	return view
+}
+
+// setTags replaces the user's tags on t with names, creating missing tags.
+func (m *Memory) setTags(userID int, t *memTodo, names []string) {
+	for id := range t.tagIDs {
+		if m.tags[id].userID == userID {
+			delete(t.tagIDs, id)
+		}
+	}
+	for _, name := range uniqueNames(names) {
+		tag := m.tagByName(userID, name)
+		if tag == nil {
+			tag = m.newTag(userID, name)
+		}
+		t.tagIDs[tag.ID] = true
+	}
+}
+
+func (m *Memory) tagByName(userID int, name string) *memTag {
+	for _, tag := range m.tags {
+		if tag.userID == userID && tag.Name == name {
+			return tag
+		}
+	}
+	return nil
+}
+
+func (m *Memory) newTag(userID int, name string) *memTag {
+	m.nextTagID++
+	tag := &memTag{Tag: api.Tag{ID: m.nextTagID, Name: name, CreatedAt: now()}, userID: userID}
+	m.tags[tag.ID] = tag
+	return tag
+}
+
+func (m *Memory) GetUserTags(ctx context.Context, userID int) ([]api.Tag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tags := []api.Tag{}
+	for _, tag := range m.tags {
+		if tag.userID == userID {
+			tags = append(tags, tag.Tag)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+func (m *Memory) CreateTag(ctx context.Context, userID int, name string) (api.Tag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tagByName(userID, name) != nil {
+		return api.Tag{}, ErrTagExists
+	}
+	return m.newTag(userID, name).Tag, nil
+}
+
+func (m *Memory) RenameTag(ctx context.Context, userID, tagID int, name string) (api.Tag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tag, ok := m.tags[tagID]
+	if !ok || tag.userID != userID {
+		return api.Tag{}, ErrNotFound
+	}
+	if other := m.tagByName(userID, name); other != nil && other != tag {
+		return api.Tag{}, ErrTagExists
+	}
+	tag.Name = name
+	m.bumpTagged(tagID)
+	return tag.Tag, nil
+}
+
+func (m *Memory) DeleteTag(ctx context.Context, userID, tagID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tag, ok := m.tags[tagID]
+	if !ok || tag.userID != userID {
+		return ErrNotFound
+	}
+	m.bumpTagged(tagID)
+	delete(m.tags, tagID)
+	for _, t := range m.todos {
+		delete(t.tagIDs, tagID)
+	}
+	return nil
+}
+
+func (m *Memory) bumpTagged(tagID int) {
+	for _, t := range m.todos {
+		if t.tagIDs[tagID] {
+			t.Version++
+		}
+	}
+}
+
+func (m *Memory) CreateUser(ctx context.Context, username, passwordHash string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if strings.EqualFold(u.Username, username) {
+			return 0, ErrUsernameTaken
+		}
+	}
+	m.nextUserID++
+	m.users[m.nextUserID] = &api.User{ID: m.nextUserID, Username: username, PasswordHash: passwordHash}
+	m.newList(InboxName, m.nextUserID).inboxOf = m.nextUserID
+	return m.nextUserID, nil
+}
+
+func (m *Memory) GetUserByUsername(ctx context.Context, username string) (*api.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if strings.EqualFold(u.Username, username) {
+			user := *u
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) CreateRefreshToken(ctx context.Context, userID int, familyID, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.refresh[tokenHash]; ok {
+		return fmt.Errorf("refresh token already exists")
+	}
+	m.refresh[tokenHash] = &memRefreshToken{userID: userID, familyID: familyID, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *Memory) revokeFamily(familyID string) {
+	for _, t := range m.refresh {
+		if t.familyID == familyID {
+			t.revoked = true
+		}
+	}
+}
+
+func (m *Memory) RevokeRefreshToken(ctx context.Context, userID int, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.refresh[tokenHash]; ok && t.userID == userID {
+		m.revokeFamily(t.familyID)
+	}
+	return nil
+}
+
+func (m *Memory) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.refresh[oldHash]
+	switch {
+	case !ok:
+		return 0, ErrRefreshTokenNotFound
+	case t.used:
+		m.revokeFamily(t.familyID)
+		return 0, ErrRefreshTokenReused
+	case t.revoked:
+		return 0, ErrRefreshTokenRevoked
+	case now().After(t.expiresAt):
+		return 0, ErrRefreshTokenExpired
+	}
+
+	t.used = true
+	m.refresh[newHash] = &memRefreshToken{userID: t.userID, familyID: t.familyID, expiresAt: expiresAt}
+	return t.userID, nil
+}
+
+func (m *Memory) RevokeToken(ctx context.Context, jti string, userID int, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, t := range m.revoked {
+		if t.ExpiresAt.Before(now()) {
+			delete(m.revoked, id)
+		}
+	}
+	if _, ok := m.revoked[jti]; !ok {
+		m.revoked[jti] = RevokedToken{JTI: jti, UserID: userID, ExpiresAt: expiresAt}
+	}
+	return nil
+}
+
+func (m *Memory) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.revoked[jti]
+	return ok && t.ExpiresAt.After(now()), nil
+}
+
+func (m *Memory) ListRevokedTokens(ctx context.Context) ([]RevokedToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tokens []RevokedToken
+	for _, t := range m.revoked {
+		if t.ExpiresAt.After(now()) {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+func (m *Memory) GetTokenVersion(ctx context.Context, userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return u.TokenVersion, nil
+}
+
+func (m *Memory) IncrementTokenVersion(ctx context.Context, userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	u.TokenVersion++
+	for _, t := range m.refresh {
+		if t.userID == userID {
+			t.revoked = true
+		}
+	}
+	return u.TokenVersion, nil
+}
+
+func (m *Memory) role(userID, listID int) (string, bool) {
+	l, ok := m.lists[listID]
+	if !ok {
+		return "", false
+	}
+	role, ok := l.members[userID]
+	return role, ok
+}
+
+func (m *Memory) requireRole(userID, listID int, roles ...string) (*memList, error) {
+	role, ok := m.role(userID, listID)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !hasRole(role, roles...) {
+		return nil, ErrForbidden
+	}
+	return m.lists[listID], nil
+}
+
+func (m *Memory) inbox(userID int) *memList {
+	for _, l := range m.lists {
+		if l.inboxOf == userID {
+			return l
+		}
+	}
+	return nil
+}
+
+func (m *Memory) newList(name string, ownerID int) *memList {
+	m.nextListID++
+	l := &memList{id: m.nextListID, name: name, createdAt: now(), members: map[int]string{ownerID: api.RoleOwner}}
+	m.lists[l.id] = l
+	return l
+}
+
+// view is the list as userID sees it, with members if asked for.
+func (m *Memory) view(l *memList, userID int, withMembers bool) api.List {
+	v := api.List{ID: l.id, Name: l.name, Inbox: l.inboxOf != 0, Role: l.members[userID], CreatedAt: l.createdAt}
+	if withMembers {
+		for id, role := range l.members {
+			v.Members = append(v.Members, api.Member{UserID: id, Username: m.users[id].Username, Role: role})
+		}
+		sort.Slice(v.Members, func(i, j int) bool { return v.Members[i].UserID < v.Members[j].UserID })
+	}
+	return v
+}
+
+func (m *Memory) CreateList(ctx context.Context, userID int, name string) (api.List, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.view(m.newList(name, userID), userID, false), nil
+}
+
+func (m *Memory) GetUserLists(ctx context.Context, userID int) ([]api.List, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lists := []api.List{}
+	for _, l := range m.lists {
+		if _, ok := l.members[userID]; ok {
+			lists = append(lists, m.view(l, userID, false))
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		if lists[i].Inbox != lists[j].Inbox {
+			return lists[i].Inbox
+		}
+		return lists[i].ID < lists[j].ID
+	})
+	return lists, nil
+}
+
+func (m *Memory) GetUserList(ctx context.Context, userID, listID int) (api.List, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.requireRole(userID, listID, api.RoleOwner, api.RoleEditor, api.RoleViewer)
+	if err != nil {
+		return api.List{}, err
+	}
+	return m.view(l, userID, true), nil
+}
+
+func (m *Memory) RenameList(ctx context.Context, userID, listID int, name string) (api.List, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.requireRole(userID, listID, api.RoleOwner)
+	if err != nil {
+		return api.List{}, err
+	}
+	l.name = name
+	return m.view(l, userID, true), nil
+}
+
+func (m *Memory) DeleteList(ctx context.Context, userID, listID int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.requireRole(userID, listID, api.RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	if l.inboxOf != 0 {
+		return nil, ErrInbox
+	}
+	for id, t := range m.todos {
+		if t.ListID == listID {
+			delete(m.todos, id)
+		}
+	}
+	for id, i := range m.invites {
+		if i.listID == listID {
+			delete(m.invites, id)
+		}
+	}
+	delete(m.lists, listID)
+	return memberIDs(l.members), nil
+}
+
+func (m *Memory) SetMemberRole(ctx context.Context, userID, listID, memberID int, role string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("%w %q", ErrInvalidRole, role)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.lists[listID]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := checkMemberChange(l.members, userID, memberID, role); err != nil {
+		return err
+	}
+	l.members[memberID] = role
+	return nil
+}
+
+func (m *Memory) RemoveMember(ctx context.Context, userID, listID, memberID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.lists[listID]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := checkMemberChange(l.members, userID, memberID, ""); err != nil {
+		return err
+	}
+	delete(l.members, memberID)
+	return nil
+}
+
+func (m *Memory) inviteView(i *memInvite) api.Invite {
+	return api.Invite{
+		ID:        i.id,
+		ListID:    i.listID,
+		ListName:  m.lists[i.listID].name,
+		Username:  m.users[i.userID].Username,
+		Role:      i.role,
+		InvitedBy: m.users[i.invitedBy].Username,
+		CreatedAt: i.createdAt,
+	}
+}
+
+func (m *Memory) CreateInvite(ctx context.Context, userID, listID int, username, role string) (api.Invite, error) {
+	if !ValidRole(role) {
+		return api.Invite{}, fmt.Errorf("%w %q", ErrInvalidRole, role)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, err := m.requireRole(userID, listID, api.RoleOwner)
+	if err != nil {
+		return api.Invite{}, err
+	}
+	if l.inboxOf != 0 {
+		return api.Invite{}, ErrInbox
+	}
+
+	var invitee *api.User
+	for _, u := range m.users {
+		if strings.EqualFold(u.Username, username) {
+			invitee = u
+		}
+	}
+	if invitee == nil {
+		return api.Invite{}, ErrUnknownUser
+	}
+	if _, ok := l.members[invitee.ID]; ok {
+		return api.Invite{}, ErrAlreadyMember
+	}
+	for _, i := range m.invites {
+		if i.listID == listID && i.userID == invitee.ID {
+			return api.Invite{}, ErrAlreadyInvited
+		}
+	}
+
+	m.nextInviteID++
+	i := &memInvite{id: m.nextInviteID, listID: listID, userID: invitee.ID, role: role, invitedBy: userID, createdAt: now()}
+	m.invites[i.id] = i
+	return m.inviteView(i), nil
+}
+
+func (m *Memory) GetUserInvites(ctx context.Context, userID int) ([]api.Invite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invites := []api.Invite{}
+	for _, i := range m.invites {
+		if i.userID == userID {
+			invites = append(invites, m.inviteView(i))
+		}
+	}
+	sort.Slice(invites, func(a, b int) bool { return invites[a].ID < invites[b].ID })
+	return invites, nil
+}
+
+func (m *Memory) AcceptInvite(ctx context.Context, userID, inviteID int) (api.List, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.invites[inviteID]
+	if !ok || i.userID != userID {
+		return api.List{}, ErrNotFound
+	}
+	l := m.lists[i.listID]
+	if _, ok := l.members[userID]; ok {
+		return api.List{}, ErrAlreadyMember
+	}
+	delete(m.invites, inviteID)
+	l.members[userID] = i.role
+	return m.view(l, userID, true), nil
+}
+
+func (m *Memory) DeclineInvite(ctx context.Context, userID, inviteID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.invites[inviteID]
+	if !ok || i.userID != userID {
+		return ErrNotFound
+	}
+	delete(m.invites, inviteID)
+	return nil
+}
@@ -0,0 +1,73 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadEmbedded(t *testing.T) {
+	postgres, err := load(files, "postgres")
+	if err != nil {
+		t.Fatalf("embedded postgres migrations do not load: %v", err)
+	}
+	for i, m := range postgres {
+		if m.Version != i+1 {
+			t.Errorf("expected versions without gaps; got %d at position %d", m.Version, i)
+		}
+	}
+
+	sqlite, err := load(files, "sqlite")
+	if err != nil {
+		t.Fatalf("embedded sqlite migrations do not load: %v", err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("expected the same migrations for both dialects; got %d postgres and %d sqlite", len(postgres), len(sqlite))
+	}
+	for i := range postgres {
+		if postgres[i].Version != sqlite[i].Version || postgres[i].Name != sqlite[i].Name {
+			t.Errorf("migration %d differs between dialects: %04d_%s vs %04d_%s", i,
+				postgres[i].Version, postgres[i].Name, sqlite[i].Version, sqlite[i].Name)
+		}
+	}
+}
+
+func TestLoadRejectsBrokenSets(t *testing.T) {
+	testCases := []struct {
+		name  string
+		files fstest.MapFS
+		err   string
+	}{
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"m/0001_init.up.sql": {Data: []byte("SELECT 1")},
+			},
+			err: "needs both",
+		},
+		{
+			name: "bad version",
+			files: fstest.MapFS{
+				"m/first_init.up.sql": {Data: []byte("SELECT 1")},
+			},
+			err: "invalid version",
+		},
+		{
+			name: "name mismatch",
+			files: fstest.MapFS{
+				"m/0001_init.up.sql":    {Data: []byte("SELECT 1")},
+				"m/0001_other.down.sql": {Data: []byte("SELECT 1")},
+			},
+			err: "two names",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := load(tc.files, "m")
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error containing %q; got %v", tc.err, err)
+			}
+		})
+	}
+}
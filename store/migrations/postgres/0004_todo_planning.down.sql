@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS todos_user_id_due_at_idx;
+
+ALTER TABLE todos
+    DROP COLUMN IF EXISTS priority,
+    DROP COLUMN IF EXISTS due_at,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS completed_at;
@@ -0,0 +1,38 @@
+CREATE TABLE lists (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    -- The user whose personal inbox this is; NULL for lists made to share.
+    inbox_of INTEGER UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE list_members (
+    list_id INTEGER NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    PRIMARY KEY (list_id, user_id)
+);
+
+CREATE INDEX list_members_user_id_idx ON list_members (user_id);
+
+CREATE TABLE list_invites (
+    id SERIAL PRIMARY KEY,
+    list_id INTEGER NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    invited_by INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (list_id, user_id)
+);
+
+CREATE INDEX list_invites_user_id_idx ON list_invites (user_id);
+
+-- Every existing user gets an inbox holding the todos they had so far.
+INSERT INTO lists (name, inbox_of) SELECT 'Inbox', id FROM users;
+INSERT INTO list_members (list_id, user_id, role) SELECT id, inbox_of, 'owner' FROM lists;
+
+ALTER TABLE todos ADD COLUMN list_id INTEGER REFERENCES lists (id) ON DELETE CASCADE;
+UPDATE todos SET list_id = (SELECT id FROM lists WHERE inbox_of = todos.user_id);
+ALTER TABLE todos ALTER COLUMN list_id SET NOT NULL;
+
+CREATE INDEX todos_list_id_idx ON todos (list_id);
@@ -0,0 +1,5 @@
+ALTER TABLE todos
+    DROP COLUMN IF EXISTS subtasks_total,
+    DROP COLUMN IF EXISTS subtasks_done;
+
+DROP TABLE IF EXISTS subtasks;
@@ -0,0 +1,17 @@
+CREATE TABLE subtasks (
+    id SERIAL PRIMARY KEY,
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    task TEXT NOT NULL,
+    completed BOOLEAN NOT NULL DEFAULT FALSE,
+    position INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ
+);
+
+CREATE INDEX subtasks_todo_id_position_idx ON subtasks (todo_id, position);
+
+-- Kept up to date by the store with every subtask change, so listing todos
+-- does not have to count subtasks.
+ALTER TABLE todos
+    ADD COLUMN subtasks_total INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN subtasks_done INTEGER NOT NULL DEFAULT 0;
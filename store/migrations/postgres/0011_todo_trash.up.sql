@@ -0,0 +1,4 @@
+-- deleted_at is set while a todo is in the trash. Trashed todos are left out
+-- of everything but the trash until they are restored or purged.
+ALTER TABLE todos ADD COLUMN deleted_at TIMESTAMPTZ;
+CREATE INDEX todos_deleted_at_idx ON todos (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS todos_user_id_due_at_idx;
+
+ALTER TABLE todos DROP COLUMN priority;
+ALTER TABLE todos DROP COLUMN due_at;
+ALTER TABLE todos DROP COLUMN created_at;
+ALTER TABLE todos DROP COLUMN updated_at;
+ALTER TABLE todos DROP COLUMN completed_at;
@@ -0,0 +1,11 @@
+-- SQLite cannot add a column with a non-constant default, so created_at and
+-- updated_at are backfilled and always written by the store afterwards.
+ALTER TABLE todos ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE todos ADD COLUMN due_at TIMESTAMP;
+ALTER TABLE todos ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+ALTER TABLE todos ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+ALTER TABLE todos ADD COLUMN completed_at TIMESTAMP;
+
+UPDATE todos SET created_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now'), updated_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now');
+
+CREATE INDEX todos_user_id_due_at_idx ON todos (user_id, due_at);
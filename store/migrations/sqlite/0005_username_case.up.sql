@@ -0,0 +1,3 @@
+-- Usernames are unique regardless of case. Fails if existing rows differ
+-- only in case; rename one of them first.
+CREATE UNIQUE INDEX users_username_lower_key ON users (lower(username));
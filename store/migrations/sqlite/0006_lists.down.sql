@@ -0,0 +1,7 @@
+-- Todos stay with the user who created them.
+DROP INDEX IF EXISTS todos_list_id_idx;
+ALTER TABLE todos DROP COLUMN list_id;
+
+DROP TABLE IF EXISTS list_invites;
+DROP TABLE IF EXISTS list_members;
+DROP TABLE IF EXISTS lists;
@@ -0,0 +1,39 @@
+CREATE TABLE lists (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    -- The user whose personal inbox this is; NULL for lists made to share.
+    inbox_of INTEGER UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE list_members (
+    list_id INTEGER NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    PRIMARY KEY (list_id, user_id)
+);
+
+CREATE INDEX list_members_user_id_idx ON list_members (user_id);
+
+CREATE TABLE list_invites (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    list_id INTEGER NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    invited_by INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (list_id, user_id)
+);
+
+CREATE INDEX list_invites_user_id_idx ON list_invites (user_id);
+
+-- Every existing user gets an inbox holding the todos they had so far.
+INSERT INTO lists (name, inbox_of, created_at)
+SELECT 'Inbox', id, strftime('%Y-%m-%d %H:%M:%S+00:00', 'now') FROM users;
+INSERT INTO list_members (list_id, user_id, role) SELECT id, inbox_of, 'owner' FROM lists;
+
+-- SQLite cannot make an added column NOT NULL; the store always sets it.
+ALTER TABLE todos ADD COLUMN list_id INTEGER REFERENCES lists (id) ON DELETE CASCADE;
+UPDATE todos SET list_id = (SELECT id FROM lists WHERE inbox_of = todos.user_id);
+
+CREATE INDEX todos_list_id_idx ON todos (list_id);
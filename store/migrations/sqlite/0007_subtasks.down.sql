@@ -0,0 +1,4 @@
+ALTER TABLE todos DROP COLUMN subtasks_total;
+ALTER TABLE todos DROP COLUMN subtasks_done;
+
+DROP TABLE IF EXISTS subtasks;
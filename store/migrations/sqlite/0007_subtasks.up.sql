@@ -0,0 +1,16 @@
+CREATE TABLE subtasks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    todo_id INTEGER NOT NULL REFERENCES todos (id) ON DELETE CASCADE,
+    task TEXT NOT NULL,
+    completed BOOLEAN NOT NULL DEFAULT FALSE,
+    position INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX subtasks_todo_id_position_idx ON subtasks (todo_id, position);
+
+-- Kept up to date by the store with every subtask change, so listing todos
+-- does not have to count subtasks.
+ALTER TABLE todos ADD COLUMN subtasks_total INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE todos ADD COLUMN subtasks_done INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE todos DROP COLUMN recurrence;
+ALTER TABLE todos DROP COLUMN timezone;
+ALTER TABLE todos DROP COLUMN recurrence_start;
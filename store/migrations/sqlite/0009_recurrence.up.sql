@@ -0,0 +1,8 @@
+-- recurrence is a canonical RRULE and timezone the IANA zone its occurrences
+-- are computed in (NULL for UTC). recurrence_start is the first due date of
+-- the series; later occurrences are counted from it, so one that had to move
+-- (past a daylight saving gap, or to the end of a short month) does not shift
+-- the rest of the series.
+ALTER TABLE todos ADD COLUMN recurrence TEXT;
+ALTER TABLE todos ADD COLUMN timezone TEXT;
+ALTER TABLE todos ADD COLUMN recurrence_start TIMESTAMP;
@@ -0,0 +1,3 @@
+-- Goes up by one with every change to a todo; it is the todo's ETag and what
+-- If-Match compares against.
+ALTER TABLE todos ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
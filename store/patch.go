@@ -0,0 +1,49 @@
+package store
+
+import (
+	"time"
+	"todo-api-v1/api"
+)
+
+// TodoPatch is a partial update of todo ID for PatchUserTodo. Nil fields are
+// left as they are.
+type TodoPatch struct {
+	ID        int
+	ListID    *int
+	Task      *string
+	Completed *bool
+	Priority  *int
+	// DueAt is only applied with SetDueAt, so that a nil DueAt can clear the
+	// due date.
+	DueAt      *time.Time
+	SetDueAt   bool
+	Recurrence *string // "" stops the todo recurring
+	Timezone   *string // "" means UTC
+	// Tags replace the user's tags on the todo; nil keeps them and an empty
+	// slice removes them.
+	Tags []string
+	// IfVersion makes the patch fail with ErrVersionMismatch unless the todo
+	// is still at this version; 0 patches whatever is stored.
+	IfVersion int
+}
+
+// ReplaceTodo is the patch UpdateUserTodo applies: every editable field of t,
+// except that a zero ListID and nil Tags keep the current values.
+func ReplaceTodo(t api.Todo) TodoPatch {
+	p := TodoPatch{
+		ID:         t.ID,
+		Task:       &t.Task,
+		Completed:  &t.Completed,
+		Priority:   &t.Priority,
+		DueAt:      t.DueAt,
+		SetDueAt:   true,
+		Recurrence: &t.Recurrence,
+		Timezone:   &t.Timezone,
+		Tags:       t.Tags,
+		IfVersion:  t.Version,
+	}
+	if t.ListID != 0 {
+		p.ListID = &t.ListID
+	}
+	return p
+}
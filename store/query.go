@@ -0,0 +1,242 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"todo-api-v1/api"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+)
+
+// Sort orders accepted by GetUserTodos. A leading "-" means descending.
+const (
+	SortCreated      = "created"
+	SortCreatedDesc  = "-created"
+	SortTask         = "task"
+	SortTaskDesc     = "-task"
+	SortPriority     = "priority"
+	SortPriorityDesc = "-priority"
+	SortDue          = "due"
+	SortDueDesc      = "-due"
+)
+
+// Due filters accepted by GetUserTodos. Both only consider open todos.
+const (
+	DueOverdue = "overdue" // due_at already passed
+	DueWeek    = "week"    // due within the next 7 days
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TodoQuery narrows down and pages through the todos a user can see.
+type TodoQuery struct {
+	Limit     int
+	ListID    int    // only todos in this list; 0 for all of the user's lists
+	Cursor    string // opaque, taken from a previous page's NextCursor
+	Completed *bool
+	Search    string   // case-insensitive substring of task
+	Tags      []string // names of the user's tags the todos must have
+	AnyTag    bool     // match todos with any of Tags instead of all of them
+	Sort      string
+	Due       string // DueOverdue or DueWeek
+	DueAfter  *time.Time
+	DueBefore *time.Time
+	Now       time.Time // reference time for Due, defaults to time.Now()
+	Trashed   bool      // list the trash instead of the live todos
+}
+
+// cursor is the position after the last row of a page. It carries the sort it
+// was produced for, so it cannot be replayed against a different ordering.
+type cursor struct {
+	Sort     string     `json:"s"`
+	ID       int        `json:"id"`
+	Task     string     `json:"t,omitempty"`
+	Priority int        `json:"p,omitempty"`
+	Due      *time.Time `json:"d,omitempty"`
+}
+
+func cursorAfter(sort string, t api.Todo) cursor {
+	c := cursor{Sort: sort, ID: t.ID}
+	switch strings.TrimPrefix(sort, "-") {
+	case SortTask:
+		c.Task = t.Task
+	case SortPriority:
+		c.Priority = t.Priority
+	case SortDue:
+		c.Due = t.DueAt
+	}
+	return c
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s, sort string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// ValidSort reports whether s is one of the supported sort orders.
+func ValidSort(s string) bool {
+	switch s {
+	case SortCreated, SortCreatedDesc, SortTask, SortTaskDesc,
+		SortPriority, SortPriorityDesc, SortDue, SortDueDesc:
+		return true
+	}
+	return false
+}
+
+// ValidDue reports whether s is one of the supported due filters.
+func ValidDue(s string) bool {
+	return s == DueOverdue || s == DueWeek
+}
+
+// escapeLike makes a user supplied string match literally inside LIKE.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// normalize applies the defaults and validates q. Every backend calls it
+// before running a query.
+func (q TodoQuery) normalize() (TodoQuery, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageSize
+	}
+	if q.Limit > MaxPageSize {
+		q.Limit = MaxPageSize
+	}
+	if q.Sort == "" {
+		q.Sort = SortCreated
+	}
+	if !ValidSort(q.Sort) {
+		return q, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	if q.Now.IsZero() {
+		q.Now = now()
+	}
+	// Duplicates would throw off the count that matches all tags.
+	q.Tags = uniqueNames(q.Tags)
+	return q, nil
+}
+
+// page cuts the limit+1 rows a backend fetched down to a page, setting the
+// cursor when there is more to read.
+func (q TodoQuery) page(todos []api.Todo) api.TodoPage {
+	page := api.TodoPage{Data: todos}
+	if len(todos) > q.Limit {
+		page.Data = todos[:q.Limit]
+		page.HasMore = true
+		page.NextCursor = encodeCursor(cursorAfter(q.Sort, page.Data[q.Limit-1]))
+	}
+	return page
+}
+
+// buildTodoQuery turns q into keyset pagination SQL. It fetches one row more
+// than the limit so the caller can tell whether another page exists.
+func buildTodoQuery(d dialect, userID int, q TodoQuery) (string, []interface{}, error) {
+	args := []interface{}{userID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := []string{canRead("$1"), notTrashed}
+	if q.Trashed {
+		where[1] = trashed
+	}
+	if q.ListID != 0 {
+		where = append(where, "list_id = "+arg(q.ListID))
+	}
+	if q.Completed != nil {
+		where = append(where, "completed = "+arg(*q.Completed))
+	}
+	if q.Search != "" {
+		where = append(where, fmt.Sprintf(`task %s %s ESCAPE '\'`, d.ilike, arg("%"+escapeLike(q.Search)+"%")))
+	}
+	if len(q.Tags) > 0 {
+		names := make([]string, len(q.Tags))
+		for i, name := range q.Tags {
+			names[i] = arg(name)
+		}
+		cond := fmt.Sprintf(`id IN (SELECT tt.todo_id FROM todo_tags tt JOIN tags t ON t.id = tt.tag_id
+			WHERE t.user_id = $1 AND t.name IN (%s) GROUP BY tt.todo_id`, strings.Join(names, ", "))
+		if !q.AnyTag {
+			cond += " HAVING COUNT(*) = " + arg(len(q.Tags))
+		}
+		where = append(where, cond+")")
+	}
+	switch q.Due {
+	case DueOverdue:
+		where = append(where, "NOT completed", "due_at < "+arg(q.Now.UTC()))
+	case DueWeek:
+		where = append(where, "NOT completed", "due_at >= "+arg(q.Now.UTC()), "due_at < "+arg(q.Now.UTC().Add(7*24*time.Hour)))
+	}
+	if q.DueAfter != nil {
+		where = append(where, "due_at >= "+arg(q.DueAfter.UTC()))
+	}
+	if q.DueBefore != nil {
+		where = append(where, "due_at < "+arg(q.DueBefore.UTC()))
+	}
+
+	field := strings.TrimPrefix(q.Sort, "-")
+	op, dir := ">", "ASC"
+	if strings.HasPrefix(q.Sort, "-") {
+		op, dir = "<", "DESC"
+	}
+
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return "", nil, err
+		}
+		switch field {
+		case SortTask:
+			where = append(where, fmt.Sprintf("(task, id) %s (%s, %s)", op, arg(c.Task), arg(c.ID)))
+		case SortPriority:
+			where = append(where, fmt.Sprintf("(priority, id) %s (%s, %s)", op, arg(c.Priority), arg(c.ID)))
+		case SortDue:
+			// Todos without a due date come last in both directions.
+			if c.Due == nil {
+				where = append(where, fmt.Sprintf("(due_at IS NULL AND id %s %s)", op, arg(c.ID)))
+			} else {
+				due := arg(c.Due.UTC())
+				where = append(where, fmt.Sprintf("(due_at %s %s OR (due_at = %s AND id %s %s) OR due_at IS NULL)",
+					op, due, due, op, arg(c.ID)))
+			}
+		default:
+			where = append(where, fmt.Sprintf("id %s %s", op, arg(c.ID)))
+		}
+	}
+
+	var orderBy string
+	switch field {
+	case SortTask:
+		orderBy = fmt.Sprintf("task %s, id %s", dir, dir)
+	case SortPriority:
+		orderBy = fmt.Sprintf("priority %s, id %s", dir, dir)
+	case SortDue:
+		orderBy = fmt.Sprintf("due_at %s NULLS LAST, id %s", dir, dir)
+	default:
+		orderBy = "id " + dir
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM todos WHERE %s ORDER BY %s LIMIT %s",
+		todoColumns, strings.Join(where, " AND "), orderBy, arg(q.Limit+1))
+	return query, args, nil
+}
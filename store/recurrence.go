@@ -0,0 +1,81 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+	"todo-api-v1/api"
+	"todo-api-v1/recurrence"
+)
+
+// nextDue works out when the occurrence after t is due, t having been
+// completed at completedAt. The series runs from start, and occurrences
+// already missed by then are skipped. ok is false once the series has ended.
+func nextDue(t api.Todo, start, completedAt time.Time) (next time.Time, ok bool, err error) {
+	rule, err := recurrence.Parse(t.Recurrence)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("todo %d: %w", t.ID, err)
+	}
+	loc := time.UTC
+	if t.Timezone != "" {
+		if loc, err = time.LoadLocation(t.Timezone); err != nil {
+			return time.Time{}, false, fmt.Errorf("todo %d: %w", t.ID, err)
+		}
+	}
+	after := completedAt
+	if t.DueAt != nil && t.DueAt.After(after) {
+		after = *t.DueAt
+	}
+	next, ok = rule.Next(start.In(loc), after)
+	return next.UTC(), ok, nil
+}
+
+// createNextOccurrence copies the just completed todo t into a new open todo
+// due at the next occurrence, with its tags and its subtasks reopened, and
+// takes the schedule off t so the series only ever continues from one todo.
+func (s *SQLStore) createNextOccurrence(ctx context.Context, tx *sql.Tx, t api.Todo, ts time.Time) error {
+	var start sql.NullTime
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT recurrence_start FROM todos WHERE id = $1`),
+		t.ID).Scan(&start); err != nil {
+		return err
+	}
+	if !start.Valid && t.DueAt != nil {
+		start = sql.NullTime{Time: *t.DueAt, Valid: true}
+	}
+
+	if start.Valid {
+		next, ok, err := nextDue(t, start.Time, ts)
+		if err != nil {
+			return err
+		}
+		if ok {
+			var id int
+			if err := tx.QueryRowContext(ctx, s.dialect.rebind(
+				`INSERT INTO todos (list_id, task, completed, priority, due_at, created_at, updated_at, user_id,
+				                    subtasks_total, subtasks_done, recurrence, timezone, recurrence_start)
+				 SELECT list_id, task, FALSE, priority, $1, $2, $2, user_id,
+				        subtasks_total, 0, recurrence, timezone, $3
+				 FROM todos WHERE id = $4
+				 RETURNING id`),
+				next, ts, start.Time.UTC(), t.ID).Scan(&id); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+				`INSERT INTO subtasks (todo_id, task, completed, position, created_at)
+				 SELECT $1, task, FALSE, position, $2 FROM subtasks WHERE todo_id = $3`),
+				id, ts, t.ID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+				`INSERT INTO todo_tags (todo_id, tag_id) SELECT $1, tag_id FROM todo_tags WHERE todo_id = $2`),
+				id, t.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`UPDATE todos SET recurrence = NULL, timezone = NULL, recurrence_start = NULL WHERE id = $1`), t.ID)
+	return err
+}
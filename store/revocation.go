@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// RevokedToken is an access token ID that was logged out before it expired.
+type RevokedToken struct {
+	JTI       string
+	UserID    int
+	ExpiresAt time.Time
+}
+
+// RevokeToken records an access token ID as revoked until it would have
+// expired anyway. Expired rows are cleaned up on the way in.
+func (s *SQLStore) RevokeToken(ctx context.Context, jti string, userID int, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM revoked_tokens WHERE expires_at < $1`), now()); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO revoked_tokens (jti, user_id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (jti) DO NOTHING`),
+		jti, userID, expiresAt.UTC())
+	return err
+}
+
+func (s *SQLStore) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1 AND expires_at > $2)`),
+		jti, now()).Scan(&revoked)
+	return revoked, err
+}
+
+// ListRevokedTokens returns every revocation that has not expired yet, used to
+// warm the Redis copy of the list.
+func (s *SQLStore) ListRevokedTokens(ctx context.Context) ([]RevokedToken, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT jti, user_id, expires_at FROM revoked_tokens WHERE expires_at > $1`), now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []RevokedToken
+	for rows.Next() {
+		var t RevokedToken
+		if err := rows.Scan(&t.JTI, &t.UserID, &t.ExpiresAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQLStore) GetTokenVersion(ctx context.Context, userID int) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT token_version FROM users WHERE id = $1`), userID).Scan(&version)
+	return version, notFound(err)
+}
+
+// IncrementTokenVersion invalidates every access token issued to the user so
+// far and revokes all of their refresh tokens, returning the new version.
+func (s *SQLStore) IncrementTokenVersion(ctx context.Context, userID int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRowContext(ctx, s.dialect.rebind(
+		`UPDATE users SET token_version = token_version + 1 WHERE id = $1 RETURNING token_version`),
+		userID).Scan(&version)
+	if err != nil {
+		return 0, notFound(err)
+	}
+
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`UPDATE refresh_tokens SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`),
+		userID, now()); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
@@ -0,0 +1,514 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"todo-api-v1/api"
+	"todo-api-v1/store/migrations"
+
+	"github.com/lib/pq"           // Postgres driver
+	"github.com/mattn/go-sqlite3" // SQLite driver
+)
+
+// dialect holds the few places where Postgres and SQLite SQL differ. Queries
+// are written for Postgres and rebound for SQLite.
+type dialect struct {
+	name      string // also the migrations directory
+	ilike     string // case-insensitive LIKE
+	forUpdate string // row lock for read-modify-write transactions
+}
+
+var (
+	postgresDialect = dialect{name: "postgres", ilike: "ILIKE", forUpdate: " FOR UPDATE"}
+	// SQLite's LIKE is already case-insensitive for ASCII, and with
+	// _txlock=immediate every transaction holds the write lock from the start.
+	sqliteDialect = dialect{name: "sqlite", ilike: "LIKE", forUpdate: ""}
+)
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// rebind turns $1 into ?1 for SQLite, which binds ?NNN by position no matter
+// in which order the parameters show up in the statement.
+func (d dialect) rebind(query string) string {
+	if d.name != sqliteDialect.name {
+		return query
+	}
+	return placeholder.ReplaceAllString(query, "?$1")
+}
+
+// SQLStore implements Store on top of database/sql for Postgres and SQLite.
+type SQLStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+func NewPostgres(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, dialect: postgresDialect}
+}
+
+func NewSQLite(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, dialect: sqliteDialect}
+}
+
+func OpenPostgres(dataSource string) (*SQLStore, error) {
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return NewPostgres(db), nil
+}
+
+// OpenSQLite opens (or creates) the database file at path. Foreign keys are
+// switched on and a single connection is used, which is all SQLite can write
+// with anyway.
+func OpenSQLite(path string) (*SQLStore, error) {
+	dsn := path
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_fk=1&_txlock=immediate&_busy_timeout=5000"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return NewSQLite(db), nil
+}
+
+// OpenSQL opens a SQL backend by STORE_DRIVER name, postgres or sqlite.
+func OpenSQL(driver, dataSource string) (*SQLStore, error) {
+	switch driver {
+	case "postgres":
+		return OpenPostgres(dataSource)
+	case "sqlite":
+		return OpenSQLite(dataSource)
+	}
+	return nil, fmt.Errorf("unknown SQL driver %q", driver)
+}
+
+// DB exposes the underlying pool, for tests and tooling.
+func (s *SQLStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// Migrator returns the schema migrator for this store's dialect.
+func (s *SQLStore) Migrator() (*migrations.Migrator, error) {
+	return migrations.New(s.db, s.dialect.name)
+}
+
+// Migrate applies every pending migration.
+func (s *SQLStore) Migrate(ctx context.Context) ([]migrations.Migration, error) {
+	m, err := s.Migrator()
+	if err != nil {
+		return nil, err
+	}
+	return m.Up(ctx)
+}
+
+// now is the timestamp written by the store. It is taken in Go rather than
+// with NOW() so both dialects store comparable UTC values.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// nullString stores an empty string as NULL.
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+// notFound maps a missing row onto ErrNotFound and leaves other errors alone.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// conflict maps unique constraint violations of either driver onto
+// ErrConflict, keeping the driver error for logs.
+func conflict(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return fmt.Errorf("%w: %s", ErrConflict, pqErr.Constraint)
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey) {
+		return fmt.Errorf("%w: %v", ErrConflict, sqliteErr)
+	}
+	return err
+}
+
+// todoColumns is the column list every todo query selects, in the order
+// scanTodo expects.
+const todoColumns = "id, list_id, task, completed, priority, due_at, created_at, updated_at, completed_at, subtasks_done, subtasks_total, recurrence, timezone, version, deleted_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// dbtx is what *sql.DB and *sql.Tx have in common, for helpers that run
+// either on their own or as part of a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func scanTodo(row rowScanner) (api.Todo, error) {
+	var t api.Todo
+	var dueAt, completedAt, deletedAt sql.NullTime
+	var recurrence, timezone sql.NullString
+	err := row.Scan(&t.ID, &t.ListID, &t.Task, &t.Completed, &t.Priority, &dueAt, &t.CreatedAt, &t.UpdatedAt, &completedAt,
+		&t.Progress.Done, &t.Progress.Total, &recurrence, &timezone, &t.Version, &deletedAt)
+	if err != nil {
+		return api.Todo{}, notFound(err)
+	}
+	if dueAt.Valid {
+		t.DueAt = &dueAt.Time
+	}
+	if completedAt.Valid {
+		t.CompletedAt = &completedAt.Time
+	}
+	if deletedAt.Valid {
+		t.DeletedAt = &deletedAt.Time
+	}
+	t.Recurrence, t.Timezone = recurrence.String, timezone.String
+	return t, nil
+}
+
+// GetUserTodos returns one page of the todos matching q in every list the user
+// is a member of.
+func (s *SQLStore) GetUserTodos(ctx context.Context, userID int, q TodoQuery) (api.TodoPage, error) {
+	q, err := q.normalize()
+	if err != nil {
+		return api.TodoPage{}, err
+	}
+
+	query, args, err := buildTodoQuery(s.dialect, userID, q)
+	if err != nil {
+		return api.TodoPage{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return api.TodoPage{}, err // Return raw error - handler will decide status code
+	}
+	defer rows.Close()
+
+	todos := []api.Todo{}
+
+	for rows.Next() {
+		t, err := scanTodo(rows)
+		if err != nil {
+			return api.TodoPage{}, err
+		}
+		todos = append(todos, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return api.TodoPage{}, err
+	}
+	rows.Close()
+	if err := s.loadTags(ctx, s.db, userID, todos); err != nil {
+		return api.TodoPage{}, err
+	}
+
+	return q.page(todos), nil
+}
+
+// CreateUserTodo inserts t into t.ListID, or the user's inbox when that is
+// zero, and returns the stored row, including the timestamps set by the
+// store. The user needs to be an owner or editor of the list. A recurring
+// todo starts its series at DueAt.
+func (s *SQLStore) CreateUserTodo(ctx context.Context, userID int, t api.Todo) (api.Todo, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return api.Todo{}, err
+	}
+	defer tx.Rollback()
+
+	created, err := s.createTodo(ctx, tx, userID, t)
+	if err != nil {
+		return api.Todo{}, err
+	}
+	return created, tx.Commit()
+}
+
+// createTodo is CreateUserTodo inside tx.
+func (s *SQLStore) createTodo(ctx context.Context, tx *sql.Tx, userID int, t api.Todo) (api.Todo, error) {
+	if t.ListID == 0 {
+		inbox, err := s.inboxID(ctx, tx, userID)
+		if err != nil {
+			return api.Todo{}, err
+		}
+		t.ListID = inbox
+	} else if _, err := s.requireRole(ctx, tx, userID, t.ListID, api.RoleOwner, api.RoleEditor); err != nil {
+		return api.Todo{}, err
+	}
+
+	ts := now()
+	var completedAt *time.Time
+	if t.Completed {
+		completedAt = &ts
+	}
+	var start *time.Time
+	if t.Recurrence != "" {
+		start = utc(t.DueAt)
+	}
+	row := tx.QueryRowContext(ctx, s.dialect.rebind(
+		`INSERT INTO todos (list_id, task, completed, priority, due_at, created_at, updated_at, completed_at, user_id,
+		                    recurrence, timezone, recurrence_start)
+		 VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $8, $9, $10, $11)
+		 RETURNING `+todoColumns),
+		t.ListID, t.Task, t.Completed, t.Priority, utc(t.DueAt), ts, completedAt, userID,
+		nullString(t.Recurrence), nullString(t.Timezone), start)
+	created, err := scanTodo(row)
+	if err != nil {
+		return api.Todo{}, err
+	}
+	if err := s.setTodoTags(ctx, tx, userID, created.ID, t.Tags); err != nil {
+		return api.Todo{}, err
+	}
+	todos := []api.Todo{created}
+	if err := s.loadTags(ctx, tx, userID, todos); err != nil {
+		return api.Todo{}, err
+	}
+	return todos[0], nil
+}
+
+func (s *SQLStore) GetUserTodo(ctx context.Context, userID, id int) (api.Todo, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind("SELECT "+todoColumns+" FROM todos WHERE id = $1 AND "+canRead("$2")+" AND "+notTrashed), id, userID)
+	t, err := scanTodo(row)
+	if err != nil {
+		return api.Todo{}, err
+	}
+	todos := []api.Todo{t}
+	err = s.loadTags(ctx, s.db, userID, todos)
+	return todos[0], err
+}
+
+// DeleteUserTodo moves a todo in a list the user may edit to the trash.
+func (s *SQLStore) DeleteUserTodo(ctx context.Context, userID, id, version int) error {
+	return s.deleteTodo(ctx, s.db, userID, id, version)
+}
+
+func (s *SQLStore) deleteTodo(ctx context.Context, db dbtx, userID, id, version int) error {
+	res, err := db.ExecContext(ctx, s.dialect.rebind(
+		"UPDATE todos SET deleted_at = $4, version = version + 1 WHERE id = $1 AND "+canWrite("$2")+" AND "+notTrashed+
+			" AND ($3 = 0 OR version = $3)"), id, userID, version, now())
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return s.todoAccessError(ctx, db, userID, id, version)
+	}
+	return nil
+}
+
+// UpdateUserTodo replaces the editable fields of a todo; see PatchUserTodo.
+func (s *SQLStore) UpdateUserTodo(ctx context.Context, userID int, t api.Todo) (api.Todo, error) {
+	return s.PatchUserTodo(ctx, userID, ReplaceTodo(t))
+}
+
+// PatchUserTodo writes the fields set in p and returns the stored row.
+// completed_at is kept while the todo stays completed and cleared when it is
+// reopened. Moving the todo to p.ListID needs edit rights on both lists.
+// Completing a recurring todo creates its next occurrence in the same
+// transaction.
+func (s *SQLStore) PatchUserTodo(ctx context.Context, userID int, p TodoPatch) (api.Todo, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return api.Todo{}, err
+	}
+	defer tx.Rollback()
+
+	updated, err := s.patchTodo(ctx, tx, userID, p)
+	if err != nil {
+		return api.Todo{}, err
+	}
+	return updated, tx.Commit()
+}
+
+// patchTodo is PatchUserTodo inside tx.
+func (s *SQLStore) patchTodo(ctx context.Context, tx *sql.Tx, userID int, p TodoPatch) (api.Todo, error) {
+	if p.ListID != nil {
+		if _, err := s.requireRole(ctx, tx, userID, *p.ListID, api.RoleOwner, api.RoleEditor); err != nil {
+			return api.Todo{}, err
+		}
+	}
+
+	// A missing row is left for the UPDATE to report.
+	var wasCompleted bool
+	err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT completed FROM todos WHERE id = $1`+s.dialect.forUpdate),
+		p.ID).Scan(&wasCompleted)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return api.Todo{}, err
+	}
+
+	ts := now()
+	args := []interface{}{ts, p.ID, userID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	set := []string{"updated_at = $1", "version = version + 1"}
+	if p.Task != nil {
+		set = append(set, "task = "+arg(*p.Task))
+	}
+	if p.Priority != nil {
+		set = append(set, "priority = "+arg(*p.Priority))
+	}
+	if p.ListID != nil {
+		set = append(set, "list_id = "+arg(*p.ListID))
+	}
+	if p.Completed != nil {
+		c := arg(*p.Completed)
+		set = append(set, "completed = "+c,
+			fmt.Sprintf("completed_at = CASE WHEN NOT %s THEN NULL WHEN completed THEN completed_at ELSE $1 END", c),
+			fmt.Sprintf("subtasks_done = CASE WHEN %s THEN subtasks_total ELSE subtasks_done END", c))
+	}
+	if p.SetDueAt || p.Recurrence != nil || p.Timezone != nil {
+		due, rec, tz := "due_at", "recurrence", "timezone"
+		if p.SetDueAt {
+			due = arg(utc(p.DueAt))
+			set = append(set, "due_at = "+due)
+		}
+		if p.Recurrence != nil {
+			rec = arg(nullString(*p.Recurrence))
+			set = append(set, "recurrence = "+rec)
+		}
+		if p.Timezone != nil {
+			tz = arg(nullString(*p.Timezone))
+			set = append(set, "timezone = "+tz)
+		}
+		// The series keeps its start unless the schedule itself changes.
+		set = append(set, fmt.Sprintf(`recurrence_start = CASE
+		     WHEN %[2]s IS NULL THEN NULL
+		     WHEN recurrence = %[2]s AND COALESCE(timezone, '') = COALESCE(%[3]s, '') AND due_at = %[1]s THEN recurrence_start
+		     ELSE %[1]s END`, due, rec, tz))
+	}
+
+	where := "id = $2 AND " + canWrite("$3") + " AND " + notTrashed
+	if p.IfVersion != 0 {
+		where += " AND version = " + arg(p.IfVersion)
+	}
+	row := tx.QueryRowContext(ctx, s.dialect.rebind(
+		`UPDATE todos SET `+strings.Join(set, ", ")+`
+		 WHERE `+where+`
+		 RETURNING `+todoColumns), args...)
+	updated, err := scanTodo(row)
+	if errors.Is(err, ErrNotFound) {
+		return api.Todo{}, s.todoAccessError(ctx, tx, userID, p.ID, p.IfVersion)
+	}
+	if err != nil {
+		return api.Todo{}, err
+	}
+
+	if p.Completed != nil && *p.Completed {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`UPDATE subtasks SET completed = TRUE, completed_at = $1 WHERE todo_id = $2 AND NOT completed`),
+			ts, p.ID); err != nil {
+			return api.Todo{}, err
+		}
+	}
+	if p.Tags != nil {
+		if err := s.setTodoTags(ctx, tx, userID, p.ID, p.Tags); err != nil {
+			return api.Todo{}, err
+		}
+	}
+	if !wasCompleted && updated.Completed && updated.Recurrence != "" {
+		if err := s.createNextOccurrence(ctx, tx, updated, ts); err != nil {
+			return api.Todo{}, err
+		}
+		updated.Recurrence, updated.Timezone = "", ""
+	}
+	todos := []api.Todo{updated}
+	if err := s.loadTags(ctx, tx, userID, todos); err != nil {
+		return api.Todo{}, err
+	}
+	return todos[0], nil
+}
+
+func (s *SQLStore) GetUserByUsername(ctx context.Context, username string) (*api.User, error) {
+	var user api.User
+	sqlStatement := "SELECT id, username, password_hash, token_version FROM users WHERE lower(username) = lower($1)"
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(sqlStatement), username).
+		Scan(&user.ID, &user.Username, &user.PasswordHash, &user.TokenVersion)
+
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &user, nil
+}
+
+// CreateUser creates the user together with their inbox list.
+func (s *SQLStore) CreateUser(ctx context.Context, username, passwordHash string) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newUserID int
+	sqlStatement := `INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id`
+
+	err = tx.QueryRowContext(ctx, s.dialect.rebind(sqlStatement), username, passwordHash).Scan(&newUserID)
+	if err != nil {
+		// users has no other unique column, so any conflict is the username.
+		if err = conflict(err); errors.Is(err, ErrConflict) {
+			return 0, ErrUsernameTaken
+		}
+		return 0, err
+	}
+
+	var inboxID int
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind(
+		`INSERT INTO lists (name, inbox_of, created_at) VALUES ($1, $2, $3) RETURNING id`),
+		InboxName, newUserID, now()).Scan(&inboxID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, $3)`),
+		inboxID, newUserID, api.RoleOwner); err != nil {
+		return 0, err
+	}
+
+	return newUserID, tx.Commit()
+}
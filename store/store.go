@@ -2,56 +2,190 @@ package store
 
 import (
 	"context"
-	"database/sql"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"time"
 	"todo-api-v1/api"
 
 	"github.com/redis/go-redis/v9"
 )
 
-var DB *sql.DB // Global variable in store package
+// ErrNotFound is returned when a row does not exist or belongs to somebody
+// else; handlers turn it into a 404.
+var ErrNotFound = errors.New("not found")
+
+// ErrForbidden is returned when the user can see a row but their role on its
+// list does not allow the change.
+var ErrForbidden = errors.New("forbidden")
+
+// ErrConflict is returned when a write would violate a uniqueness rule.
+var ErrConflict = errors.New("conflict")
+
+// ErrVersionMismatch is returned by conditional writes when the todo has
+// changed since the version the caller expected.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// ErrUsernameTaken is returned by CreateUser when the username is in use,
+// compared case-insensitively. It is an ErrConflict.
+var ErrUsernameTaken = fmt.Errorf("username already taken: %w", ErrConflict)
+
+// TodoStore is everything the todo handlers need. Every method is scoped to
+// userID and behaves as if todos outside the user's lists did not exist;
+// changes additionally need the owner or editor role on the list.
+type TodoStore interface {
+	GetUserTodos(ctx context.Context, userID int, q TodoQuery) (api.TodoPage, error)
+	CreateUserTodo(ctx context.Context, userID int, t api.Todo) (api.Todo, error)
+	GetUserTodo(ctx context.Context, userID, id int) (api.Todo, error)
+	// UpdateUserTodo replaces the editable fields of t.ID. Completing a todo
+	// also completes its open subtasks. A non-zero t.Version must still be
+	// the stored version, or ErrVersionMismatch is returned.
+	UpdateUserTodo(ctx context.Context, userID int, t api.Todo) (api.Todo, error)
+	// PatchUserTodo changes only the fields set in p, with the same rules as
+	// UpdateUserTodo, and returns the whole stored todo.
+	PatchUserTodo(ctx context.Context, userID int, p TodoPatch) (api.Todo, error)
+	// DeleteUserTodo moves id to the trash; a non-zero version has to match
+	// as for UpdateUserTodo.
+	DeleteUserTodo(ctx context.Context, userID, id, version int) error
+	// BatchTodos runs several creates, patches and deletes in one
+	// transaction, either all or nothing or each on its own.
+	BatchTodos(ctx context.Context, userID int, ops []TodoOp, atomic bool) ([]TodoOpResult, error)
+}
 
-func InitDB() *sql.DB {
-	dbSource := os.Getenv("DB_SOURCE")
-	if dbSource == "" {
-		log.Fatal("FATAL: DB_SOURCE environment variable is not set.")
+// SubtaskStore keeps the checklist items under a todo. Access follows the
+// parent todo: reading needs any role on its list, changes need owner or
+// editor. Every change keeps the parent's Progress up to date and, when the
+// todo has subtasks, completes it once all of them are done and reopens it
+// when one is added or reopened.
+type SubtaskStore interface {
+	GetSubtasks(ctx context.Context, userID, todoID int) ([]api.Subtask, error)
+	CreateSubtask(ctx context.Context, userID, todoID int, task string) (api.Subtask, error)
+	// UpdateSubtask sets the task and completed state of st.ID under st.TodoID.
+	UpdateSubtask(ctx context.Context, userID int, st api.Subtask) (api.Subtask, error)
+	DeleteSubtask(ctx context.Context, userID, todoID, subtaskID int) error
+	// ReorderSubtasks puts the subtasks in the order of ids, which must name
+	// every subtask of the todo exactly once.
+	ReorderSubtasks(ctx context.Context, userID, todoID int, ids []int) ([]api.Subtask, error)
+}
+
+// TagStore keeps each user's tags. Tags are attached to todos through the
+// Tags field of CreateUserTodo and UpdateUserTodo.
+type TagStore interface {
+	GetUserTags(ctx context.Context, userID int) ([]api.Tag, error)
+	CreateTag(ctx context.Context, userID int, name string) (api.Tag, error)
+	RenameTag(ctx context.Context, userID, tagID int, name string) (api.Tag, error)
+	// DeleteTag deletes a tag and takes it off every todo.
+	DeleteTag(ctx context.Context, userID, tagID int) error
+}
+
+// TrashStore keeps deleted todos until they are restored or purged. Trashed
+// todos are only listed by GetUserTodos with TodoQuery.Trashed; every other
+// method acts as if they did not exist. Restoring and purging need the owner
+// or editor role, like deleting.
+type TrashStore interface {
+	RestoreUserTodo(ctx context.Context, userID, id int) (api.Todo, error)
+	// PurgeUserTodo deletes a trashed todo for good.
+	PurgeUserTodo(ctx context.Context, userID, id int) error
+	// PurgeTrash deletes every todo trashed before cutoff, for all users,
+	// and returns how many there were.
+	PurgeTrash(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// UserStore keeps accounts. Usernames are unique and looked up
+// case-insensitively. Every new user gets an inbox list.
+type UserStore interface {
+	CreateUser(ctx context.Context, username, passwordHash string) (int, error)
+	GetUserByUsername(ctx context.Context, username string) (*api.User, error)
+}
+
+// ListStore keeps lists, their members and pending invites. Every method acts
+// as userID: lists they are not a member of do not exist (ErrNotFound), and
+// changes their role does not allow fail with ErrForbidden.
+type ListStore interface {
+	CreateList(ctx context.Context, userID int, name string) (api.List, error)
+	GetUserLists(ctx context.Context, userID int) ([]api.List, error)
+	GetUserList(ctx context.Context, userID, listID int) (api.List, error)
+	RenameList(ctx context.Context, userID, listID int, name string) (api.List, error)
+	// DeleteList deletes a list with its todos and returns the IDs of the
+	// users who were members.
+	DeleteList(ctx context.Context, userID, listID int) ([]int, error)
+
+	SetMemberRole(ctx context.Context, userID, listID, memberID int, role string) error
+	RemoveMember(ctx context.Context, userID, listID, memberID int) error
+
+	CreateInvite(ctx context.Context, userID, listID int, username, role string) (api.Invite, error)
+	GetUserInvites(ctx context.Context, userID int) ([]api.Invite, error)
+	AcceptInvite(ctx context.Context, userID, inviteID int) (api.List, error)
+	DeclineInvite(ctx context.Context, userID, inviteID int) error
+}
+
+// TokenStore keeps refresh tokens and access token revocations.
+type TokenStore interface {
+	CreateRefreshToken(ctx context.Context, userID int, familyID, tokenHash string, expiresAt time.Time) error
+	RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (int, error)
+	RevokeRefreshToken(ctx context.Context, userID int, tokenHash string) error
+
+	RevokeToken(ctx context.Context, jti string, userID int, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+	ListRevokedTokens(ctx context.Context) ([]RevokedToken, error)
+	GetTokenVersion(ctx context.Context, userID int) (int, error)
+	IncrementTokenVersion(ctx context.Context, userID int) (int, error)
+}
+
+// Store is the whole persistence layer. Postgres is the production backend,
+// SQLite is for running a single binary locally and Memory is for tests.
+type Store interface {
+	TodoStore
+	SubtaskStore
+	TagStore
+	TrashStore
+	ListStore
+	UserStore
+	TokenStore
+	// Ping checks that the backend can serve requests, for readiness probes.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// InitStore opens the backend picked by STORE_DRIVER (postgres, sqlite or
+// memory, default postgres) and brings its schema up to date. DB_SOURCE is the
+// Postgres connection string or the SQLite file path.
+func InitStore() Store {
+	driver := os.Getenv("STORE_DRIVER")
+	if driver == "" {
+		driver = "postgres"
 	}
-	var err error
-	db, err := sql.Open("postgres", dbSource)
-	if err != nil {
-		log.Fatalf("FATAL: Could not connect to the database: %v", err)
+	if driver == "memory" {
+		slog.Warn("using the in-memory store, data is lost on restart")
+		return NewMemory()
 	}
 
-	if err = db.Ping(); err != nil {
-		log.Fatalf("FATAL: Could not ping the database: %v", err)
+	dbSource := os.Getenv("DB_SOURCE")
+	if dbSource == "" {
+		fatal("DB_SOURCE environment variable is not set")
 	}
 
-	// FIX: Using correct PostgreSQL syntax
-	// In your initDB() function in main.go
-	createTableSQL := `
-CREATE TABLE IF NOT EXISTS users (
-    id SERIAL PRIMARY KEY,
-    username TEXT NOT NULL UNIQUE,
-    password_hash TEXT NOT NULL
-);
-
-CREATE TABLE IF NOT EXISTS todos (
-    id SERIAL PRIMARY KEY,
-    task TEXT NOT NULL,
-    completed BOOLEAN NOT NULL,
-    user_id INTEGER NOT NULL,
-    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
-);`
-
-	if _, err = db.Exec(createTableSQL); err != nil {
-		log.Fatalf("FATAL: Could not create tables: %v", err)
+	st, err := OpenSQL(driver, dbSource)
+	if err != nil {
+		fatal("could not connect to the database", "err", err)
 	}
 
-	log.Println("Database connection successful and table created.")
+	// Schema changes live in store/migrations. Every pod runs them on start;
+	// the advisory lock inside makes that safe. AUTO_MIGRATE=false leaves it
+	// to "todo-api migrate up" instead.
+	if os.Getenv("AUTO_MIGRATE") != "false" {
+		ran, err := st.Migrate(context.Background())
+		if err != nil {
+			fatal("could not migrate the database", "err", err)
+		}
+		for _, m := range ran {
+			slog.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+	}
 
-	DB = db
-	return db
+	slog.Info("database connection successful and schema up to date", "driver", driver)
+	return st
 }
 
 func InitRedis() *redis.Client {
@@ -65,20 +199,20 @@ func InitRedis() *redis.Client {
 	// 2. Decide WHICH configuration to use
 	if redisURL != "" {
 		// Production path: Parse the full URL
-		log.Println("Found REDIS_URL, parsing for production...")
+		slog.Info("found REDIS_URL, parsing for production")
 		opt, err = redis.ParseURL(redisURL)
 		if err != nil {
-			log.Fatalf("FATAL: Could not parse Redis URL: %v", err)
+			fatal("could not parse the Redis URL", "err", err)
 		}
 	} else if redisAddr != "" {
 		// Local path: Use the simple address
-		log.Println("Found REDIS_ADDR, using simple connection for local dev...")
+		slog.Info("found REDIS_ADDR, using simple connection for local dev")
 		opt = &redis.Options{
 			Addr: redisAddr,
 		}
 	} else {
 		// No configuration found, this is a fatal error.
-		log.Fatal("FATAL: Neither REDIS_URL nor REDIS_ADDR environment variable is set.")
+		fatal("neither REDIS_URL nor REDIS_ADDR environment variable is set")
 	}
 
 	// 3. Create and test the client ONCE, at the end.
@@ -87,110 +221,16 @@ func InitRedis() *redis.Client {
 
 	// We ping to verify the connection is alive BEFORE returning.
 	if _, err := rdb.Ping(context.Background()).Result(); err != nil {
-		log.Fatalf("FATAL: Could not connect to Redis: %v", err)
+		fatal("could not connect to Redis", "err", err)
 	}
 
-	log.Println("Redis connection successful.")
+	slog.Info("redis connection successful")
 	return rdb
 }
 
-func GetUserTodos(ctx context.Context, userID interface{}) ([]api.Todo, error) {
-	rows, err := DB.QueryContext(
-		ctx,
-		"SELECT id, task, completed FROM todos WHERE user_id = $1",
-		userID,
-	)
-	if err != nil {
-		return nil, err // Return raw error - handler will decide status code
-	}
-	defer rows.Close()
-
-	var todos []api.Todo
-
-	for rows.Next() {
-		var t api.Todo
-		err = rows.Scan(&t.ID, &t.Task, &t.Completed)
-		if err != nil {
-			return nil, err
-		}
-		todos = append(todos, t)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-	return todos, nil
-}
-
-func CreateUserTodo(ctx context.Context, userID interface{}, task string, completed bool) (int, error) {
-	var newID int
-	err := DB.QueryRowContext(ctx, `INSERT INTO todos (task, completed, user_id) VALUES ($1, $2, $3) RETURNING id`, task, completed, userID).Scan(&newID)
-	if err != nil {
-		return 0, err
-	}
-	return newID, nil
-}
-
-func GetUserTodo(ctx context.Context, userID interface{}, id int) (api.Todo, error) {
-	var Todo api.Todo
-	err := DB.QueryRowContext(ctx, "SELECT id, task, completed FROM todos WHERE id = $1 and user_id = $2", id, userID).Scan(&Todo.ID, &Todo.Task, &Todo.Completed)
-
-	if err != nil {
-		return api.Todo{}, err
-	}
-	return Todo, err
-}
-
-func DeleteUserTodo(ctx context.Context, todoID int, userID interface{}) (int64, error) {
-	res, err := DB.ExecContext(ctx, "DELETE FROM todos WHERE id = $1 AND user_id = $2", todoID, userID)
-	if err != nil {
-		return 0, err
-	}
-
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return 0, err
-	}
-
-	return rowsAffected, nil
-}
-
-func UpdateUserTodo(ctx context.Context, task string, completed bool, id int, userID interface{}) (int64, error) {
-	res, err := DB.ExecContext(ctx, "UPDATE todos SET task = $1, completed = $2 WHERE id = $3 and user_id = $4", task, completed, id, userID)
-
-	if err != nil {
-		return 0, err
-	}
-
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return 0, err
-	}
-
-	return rowsAffected, nil
-
-}
-
-func GetUserByUsername(ctx context.Context, username string) (*api.User, error) {
-	var user api.User
-	sqlStatement := "SELECT id, password_hash FROM users WHERE username = $1"
-	err := DB.QueryRowContext(ctx, sqlStatement, username).Scan(&user.ID, &user.PasswordHash)
-
-	if err != nil {
-		return nil, err // Return raw error - handler decides if it's "not found" or "server error"
-	}
-
-	return &user, nil
-}
-
-func CreateUser(ctx context.Context, username, passwordHash string) (int, error) {
-	var newUserID int
-	sqlStatement := `INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id`
-
-	err := DB.QueryRowContext(ctx, sqlStatement, username, passwordHash).Scan(&newUserID)
-	if err != nil {
-		return 0, err // Return raw error - handler decides if it's duplicate username or server error
-	}
-
-	return newUserID, nil
+// fatal logs at error level and exits; the store cannot start without its
+// configuration.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"todo-api-v1/api"
+)
+
+// ErrSubtaskOrder is returned by ReorderSubtasks when the ids are not exactly
+// the subtasks of the todo.
+var ErrSubtaskOrder = errors.New("order must name every subtask of the todo once")
+
+const subtaskColumns = "id, todo_id, task, completed, position, created_at, completed_at"
+
+func scanSubtask(row rowScanner) (api.Subtask, error) {
+	var st api.Subtask
+	var completedAt sql.NullTime
+	if err := row.Scan(&st.ID, &st.TodoID, &st.Task, &st.Completed, &st.Position, &st.CreatedAt, &completedAt); err != nil {
+		return api.Subtask{}, notFound(err)
+	}
+	if completedAt.Valid {
+		st.CompletedAt = &completedAt.Time
+	}
+	return st, nil
+}
+
+func (s *SQLStore) GetSubtasks(ctx context.Context, userID, todoID int) ([]api.Subtask, error) {
+	if _, err := s.GetUserTodo(ctx, userID, todoID); err != nil {
+		return nil, err
+	}
+	return s.subtasks(ctx, s.db, todoID)
+}
+
+// subtasks returns the subtasks of a todo in order, through db or a tx.
+func (s *SQLStore) subtasks(ctx context.Context, db dbtx, todoID int) ([]api.Subtask, error) {
+	rows, err := db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT `+subtaskColumns+` FROM subtasks WHERE todo_id = $1 ORDER BY position`), todoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subtasks := []api.Subtask{}
+	for rows.Next() {
+		st, err := scanSubtask(rows)
+		if err != nil {
+			return nil, err
+		}
+		subtasks = append(subtasks, st)
+	}
+	return subtasks, rows.Err()
+}
+
+// editSubtasks runs fn in a transaction that holds the parent todo locked,
+// after checking the user may change it, and then brings the todo's progress
+// and completion in line with its subtasks. A recurring todo completed that
+// way moves on to its next occurrence, as it does when completed directly.
+func (s *SQLStore) editSubtasks(ctx context.Context, userID, todoID int, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var wasCompleted bool
+	err = tx.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT completed FROM todos WHERE id = $1 AND `+canWrite("$2")+` AND `+notTrashed+s.dialect.forUpdate),
+		todoID, userID).Scan(&wasCompleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.todoAccessError(ctx, tx, userID, todoID, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	ts := now()
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`UPDATE todos SET
+		     subtasks_total = (SELECT COUNT(*) FROM subtasks WHERE todo_id = $1),
+		     subtasks_done = (SELECT COUNT(*) FROM subtasks WHERE todo_id = $1 AND completed),
+		     updated_at = $2,
+		     version = version + 1
+		 WHERE id = $1`), todoID, ts); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`UPDATE todos SET
+		     completed = (subtasks_done = subtasks_total),
+		     completed_at = CASE WHEN subtasks_done < subtasks_total THEN NULL WHEN completed THEN completed_at ELSE $2 END
+		 WHERE id = $1 AND subtasks_total > 0`), todoID, ts); err != nil {
+		return err
+	}
+
+	if !wasCompleted {
+		t, err := scanTodo(tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+todoColumns+` FROM todos WHERE id = $1`), todoID))
+		if err != nil {
+			return err
+		}
+		if t.Completed && t.Recurrence != "" {
+			if err := s.createNextOccurrence(ctx, tx, t, ts); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) CreateSubtask(ctx context.Context, userID, todoID int, task string) (api.Subtask, error) {
+	var created api.Subtask
+	err := s.editSubtasks(ctx, userID, todoID, func(tx *sql.Tx) error {
+		var err error
+		created, err = scanSubtask(tx.QueryRowContext(ctx, s.dialect.rebind(
+			`INSERT INTO subtasks (todo_id, task, completed, position, created_at)
+			 VALUES ($1, $2, FALSE, (SELECT COALESCE(MAX(position), 0) + 1 FROM subtasks WHERE todo_id = $1), $3)
+			 RETURNING `+subtaskColumns),
+			todoID, task, now()))
+		return err
+	})
+	return created, err
+}
+
+func (s *SQLStore) UpdateSubtask(ctx context.Context, userID int, st api.Subtask) (api.Subtask, error) {
+	var updated api.Subtask
+	err := s.editSubtasks(ctx, userID, st.TodoID, func(tx *sql.Tx) error {
+		var err error
+		updated, err = scanSubtask(tx.QueryRowContext(ctx, s.dialect.rebind(
+			`UPDATE subtasks SET
+			     task = $1,
+			     completed = $2,
+			     completed_at = CASE WHEN NOT $2 THEN NULL WHEN completed THEN completed_at ELSE $3 END
+			 WHERE id = $4 AND todo_id = $5
+			 RETURNING `+subtaskColumns),
+			st.Task, st.Completed, now(), st.ID, st.TodoID))
+		return err
+	})
+	return updated, err
+}
+
+// DeleteSubtask removes a subtask and closes the gap it leaves in the order.
+func (s *SQLStore) DeleteSubtask(ctx context.Context, userID, todoID, subtaskID int) error {
+	return s.editSubtasks(ctx, userID, todoID, func(tx *sql.Tx) error {
+		var position int
+		err := tx.QueryRowContext(ctx, s.dialect.rebind(
+			`DELETE FROM subtasks WHERE id = $1 AND todo_id = $2 RETURNING position`), subtaskID, todoID).Scan(&position)
+		if err != nil {
+			return notFound(err)
+		}
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(
+			`UPDATE subtasks SET position = position - 1 WHERE todo_id = $1 AND position > $2`), todoID, position)
+		return err
+	})
+}
+
+func (s *SQLStore) ReorderSubtasks(ctx context.Context, userID, todoID int, ids []int) ([]api.Subtask, error) {
+	var subtasks []api.Subtask
+	err := s.editSubtasks(ctx, userID, todoID, func(tx *sql.Tx) error {
+		current, err := s.subtasks(ctx, tx, todoID)
+		if err != nil {
+			return err
+		}
+		if !sameSubtasks(current, ids) {
+			return ErrSubtaskOrder
+		}
+		for i, id := range ids {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+				`UPDATE subtasks SET position = $1 WHERE id = $2`), i+1, id); err != nil {
+				return err
+			}
+		}
+		subtasks, err = s.subtasks(ctx, tx, todoID)
+		return err
+	})
+	return subtasks, err
+}
+
+// sameSubtasks reports whether ids names each of subtasks exactly once.
+func sameSubtasks(subtasks []api.Subtask, ids []int) bool {
+	if len(ids) != len(subtasks) {
+		return false
+	}
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, st := range subtasks {
+		if !seen[st.ID] {
+			return false
+		}
+	}
+	return true
+}
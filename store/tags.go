@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"todo-api-v1/api"
+)
+
+// ErrTagExists is returned when the user already has a tag with the name. It
+// is an ErrConflict.
+var ErrTagExists = fmt.Errorf("tag already exists: %w", ErrConflict)
+
+// uniqueNames drops repeated names, keeping the first of each.
+func uniqueNames(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(names))
+	unique := []string{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+func scanTag(row rowScanner) (api.Tag, error) {
+	var t api.Tag
+	err := row.Scan(&t.ID, &t.Name, &t.CreatedAt)
+	return t, notFound(err)
+}
+
+func (s *SQLStore) GetUserTags(ctx context.Context, userID int) ([]api.Tag, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT id, name, created_at FROM tags WHERE user_id = $1 ORDER BY name`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []api.Tag{}
+	for rows.Next() {
+		t, err := scanTag(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+func (s *SQLStore) CreateTag(ctx context.Context, userID int, name string) (api.Tag, error) {
+	t, err := scanTag(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`INSERT INTO tags (user_id, name, created_at) VALUES ($1, $2, $3) RETURNING id, name, created_at`),
+		userID, name, now()))
+	if err = conflict(err); errors.Is(err, ErrConflict) {
+		return api.Tag{}, ErrTagExists
+	}
+	return t, err
+}
+
+func (s *SQLStore) RenameTag(ctx context.Context, userID, tagID int, name string) (api.Tag, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return api.Tag{}, err
+	}
+	defer tx.Rollback()
+
+	t, err := scanTag(tx.QueryRowContext(ctx, s.dialect.rebind(
+		`UPDATE tags SET name = $1 WHERE id = $2 AND user_id = $3 RETURNING id, name, created_at`),
+		name, tagID, userID))
+	if err = conflict(err); errors.Is(err, ErrConflict) {
+		return api.Tag{}, ErrTagExists
+	}
+	if err != nil {
+		return api.Tag{}, err
+	}
+	if err := s.bumpTagged(ctx, tx, tagID); err != nil {
+		return api.Tag{}, err
+	}
+	return t, tx.Commit()
+}
+
+func (s *SQLStore) DeleteTag(ctx context.Context, userID, tagID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Before the delete cascades to todo_tags.
+	if err := s.bumpTagged(ctx, tx, tagID); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM tags WHERE id = $1 AND user_id = $2`), tagID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// bumpTagged moves the todos carrying a tag to a new version, since their
+// tags are part of what their ETag stands for.
+func (s *SQLStore) bumpTagged(ctx context.Context, tx *sql.Tx, tagID int) error {
+	_, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`UPDATE todos SET version = version + 1 WHERE id IN (SELECT todo_id FROM todo_tags WHERE tag_id = $1)`), tagID)
+	return err
+}
+
+// setTodoTags replaces the user's tags on a todo with names, creating the
+// tags the user does not have yet. Other members' tags are left alone.
+func (s *SQLStore) setTodoTags(ctx context.Context, tx *sql.Tx, userID, todoID int, names []string) error {
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`DELETE FROM todo_tags WHERE todo_id = $1 AND tag_id IN (SELECT id FROM tags WHERE user_id = $2)`),
+		todoID, userID); err != nil {
+		return err
+	}
+	for _, name := range uniqueNames(names) {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO tags (user_id, name, created_at) VALUES ($1, $2, $3) ON CONFLICT (user_id, name) DO NOTHING`),
+			userID, name, now()); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`INSERT INTO todo_tags (todo_id, tag_id) SELECT $1, id FROM tags WHERE user_id = $2 AND name = $3`),
+			todoID, userID, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTags fills in the user's tags on todos with a single query.
+func (s *SQLStore) loadTags(ctx context.Context, db dbtx, userID int, todos []api.Todo) error {
+	if len(todos) == 0 {
+		return nil
+	}
+	args := []interface{}{userID}
+	params := make([]string, len(todos))
+	byID := make(map[int]*api.Todo, len(todos))
+	for i := range todos {
+		todos[i].Tags = []string{}
+		byID[todos[i].ID] = &todos[i]
+		args = append(args, todos[i].ID)
+		params[i] = fmt.Sprintf("$%d", len(args))
+	}
+
+	rows, err := db.QueryContext(ctx, s.dialect.rebind(
+		`SELECT tt.todo_id, t.name FROM todo_tags tt JOIN tags t ON t.id = tt.tag_id
+		 WHERE t.user_id = $1 AND tt.todo_id IN (`+strings.Join(params, ", ")+`)
+		 ORDER BY t.name`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var todoID int
+		var name string
+		if err := rows.Scan(&todoID, &name); err != nil {
+			return err
+		}
+		byID[todoID].Tags = append(byID[todoID].Tags, name)
+	}
+	return rows.Err()
+}
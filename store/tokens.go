@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenRevoked  = errors.New("refresh token revoked")
+	// ErrRefreshTokenReused means an already rotated token was presented again.
+	// By the time it is returned the whole token family has been revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// CreateRefreshToken stores the hash of a new refresh token. The raw token is
+// never persisted, only handed to the client.
+func (s *SQLStore) CreateRefreshToken(ctx context.Context, userID int, familyID, tokenHash string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)`),
+		userID, tokenHash, familyID, expiresAt.UTC(), now())
+	return err
+}
+
+// RevokeRefreshToken revokes the family of the given token for a user, as
+// done on logout. Unknown tokens or tokens of other users are ignored.
+func (s *SQLStore) RevokeRefreshToken(ctx context.Context, userID int, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`UPDATE refresh_tokens SET revoked_at = $3
+		 WHERE revoked_at IS NULL AND family_id = (
+		     SELECT family_id FROM refresh_tokens WHERE token_hash = $1 AND user_id = $2
+		 )`),
+		tokenHash, userID, now())
+	return err
+}
+
+// RotateRefreshToken marks the token identified by oldHash as used and stores
+// newHash in the same family, returning the owning user.
+//
+// Presenting a token that was already used is treated as theft: every token in
+// its family is revoked and ErrRefreshTokenReused is returned.
+func (s *SQLStore) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID    int
+		familyID  string
+		expires   time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+	)
+	// Lock the row so two concurrent refreshes of the same token serialize
+	// and the second one is seen as a replay.
+	err = tx.QueryRowContext(ctx, s.dialect.rebind(
+		`SELECT user_id, family_id, expires_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash = $1`+s.dialect.forUpdate),
+		oldHash).Scan(&userID, &familyID, &expires, &usedAt, &revokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrRefreshTokenNotFound
+		}
+		return 0, err
+	}
+
+	if usedAt.Valid {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+			`UPDATE refresh_tokens SET revoked_at = $2 WHERE family_id = $1 AND revoked_at IS NULL`),
+			familyID, now()); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return 0, ErrRefreshTokenReused
+	}
+	if revokedAt.Valid {
+		return 0, ErrRefreshTokenRevoked
+	}
+	if now().After(expires) {
+		return 0, ErrRefreshTokenExpired
+	}
+
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE refresh_tokens SET used_at = $2 WHERE token_hash = $1`), oldHash, now()); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(
+		`INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)`),
+		userID, newHash, familyID, expiresAt.UTC(), now()); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+	"todo-api-v1/api"
+)
+
+// RestoreUserTodo takes a todo out of the trash, as it was when deleted.
+func (s *SQLStore) RestoreUserTodo(ctx context.Context, userID, id int) (api.Todo, error) {
+	restored, err := scanTodo(s.db.QueryRowContext(ctx, s.dialect.rebind(
+		`UPDATE todos SET deleted_at = NULL, version = version + 1
+		 WHERE id = $1 AND `+canWrite("$2")+` AND `+trashed+`
+		 RETURNING `+todoColumns), id, userID))
+	if errors.Is(err, ErrNotFound) {
+		return api.Todo{}, s.accessError(ctx, s.db, trashed, userID, id, 0)
+	}
+	if err != nil {
+		return api.Todo{}, err
+	}
+	todos := []api.Todo{restored}
+	err = s.loadTags(ctx, s.db, userID, todos)
+	return todos[0], err
+}
+
+// PurgeUserTodo deletes a trashed todo for good.
+func (s *SQLStore) PurgeUserTodo(ctx context.Context, userID, id int) error {
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`DELETE FROM todos WHERE id = $1 AND `+canWrite("$2")+` AND `+trashed), id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return s.accessError(ctx, s.db, trashed, userID, id, 0)
+	}
+	return nil
+}
+
+// PurgeTrash deletes every todo trashed before cutoff, for all users.
+func (s *SQLStore) PurgeTrash(ctx context.Context, cutoff time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(
+		`DELETE FROM todos WHERE `+trashed+` AND deleted_at < $1`), cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (m *Memory) RestoreUserTodo(ctx context.Context, userID, id int) (api.Todo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.editableTodo(userID, id, true)
+	if err != nil {
+		return api.Todo{}, err
+	}
+	t.DeletedAt = nil
+	t.Version++
+	return m.todoView(userID, t), nil
+}
+
+func (m *Memory) PurgeUserTodo(ctx context.Context, userID, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.editableTodo(userID, id, true); err != nil {
+		return err
+	}
+	delete(m.todos, id)
+	return nil
+}
+
+func (m *Memory) PurgeTrash(ctx context.Context, cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := 0
+	for id, t := range m.todos {
+		if t.DeletedAt != nil && t.DeletedAt.Before(cutoff) {
+			delete(m.todos, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api-v1/api"
+	"todo-api-v1/store"
+)
+
+// subtaskHandler serves /todos/{id}/subtasks, /todos/{id}/subtasks/order and
+// /todos/{id}/subtasks/{subtaskID}; path is what follows "/todos/{id}/".
+func (s *Server) subtaskHandler(w http.ResponseWriter, r *http.Request, todoID int, path string) {
+	userID, ok := r.Context().Value(userKey).(int)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+
+	rest, found := strings.CutPrefix(path, "subtasks")
+	switch {
+	case !found || (rest != "" && !strings.HasPrefix(rest, "/")):
+		s.writeError(w, r, errNotFound("No such endpoint"))
+
+	case rest == "" || rest == "/":
+		switch r.Method {
+		case http.MethodGet:
+			s.getSubtasks(w, r, userID, todoID)
+		case http.MethodPost:
+			s.createSubtask(w, r, userID, todoID)
+		default:
+			s.writeError(w, r, errMethodNotAllowed)
+		}
+
+	case rest == "/order":
+		if r.Method != http.MethodPut {
+			s.writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		s.reorderSubtasks(w, r, userID, todoID)
+
+	default:
+		subtaskID, err := strconv.Atoi(rest[1:])
+		if err != nil {
+			s.writeError(w, r, errBadRequest("Invalid subtask ID"))
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			s.updateSubtask(w, r, userID, todoID, subtaskID)
+		case http.MethodDelete:
+			s.deleteSubtask(w, r, userID, todoID, subtaskID)
+		default:
+			s.writeError(w, r, errMethodNotAllowed)
+		}
+	}
+}
+
+func (s *Server) getSubtasks(w http.ResponseWriter, r *http.Request, userID, todoID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	subtasks, err := s.store.GetSubtasks(ctx, userID, todoID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNotFound("Todo not found")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subtasks)
+}
+
+func (s *Server) createSubtask(w http.ResponseWriter, r *http.Request, userID, todoID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	var body struct {
+		Task string `json:"task"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return
+	}
+	if body.Task == "" {
+		s.writeError(w, r, errInvalid(fieldError{"task", "is required"}))
+		return
+	}
+
+	created, err := s.store.CreateSubtask(ctx, userID, todoID, body.Task)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNotFound("Todo not found")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	s.invalidateTodo(ctx, todoID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (s *Server) updateSubtask(w http.ResponseWriter, r *http.Request, userID, todoID, subtaskID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	var st api.Subtask
+	if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return
+	}
+	if st.Task == "" {
+		s.writeError(w, r, errInvalid(fieldError{"task", "is required"}))
+		return
+	}
+	st.ID, st.TodoID = subtaskID, todoID
+
+	updated, err := s.store.UpdateSubtask(ctx, userID, st)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNotFound("Subtask not found")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	s.invalidateTodo(ctx, todoID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (s *Server) deleteSubtask(w http.ResponseWriter, r *http.Request, userID, todoID, subtaskID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	if err := s.store.DeleteSubtask(ctx, userID, todoID, subtaskID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNotFound("Subtask not found")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	s.invalidateTodo(ctx, todoID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) reorderSubtasks(w http.ResponseWriter, r *http.Request, userID, todoID int) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	var body struct {
+		IDs []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return
+	}
+
+	subtasks, err := s.store.ReorderSubtasks(ctx, userID, todoID, body.IDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrSubtaskOrder):
+			err = errInvalid(fieldError{"ids", "must list every subtask of the todo exactly once"})
+		case errors.Is(err, store.ErrNotFound):
+			err = errNotFound("Todo not found")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	s.invalidateTodo(ctx, todoID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subtasks)
+}
+
+// invalidateTodo drops the cached copies of a todo after a change.
+func (s *Server) invalidateTodo(ctx context.Context, todoIDs ...int) {
+	if err := s.cache.InvalidateTodo(ctx, todoIDs...); err != nil {
+		s.log(ctx).Warn("failed to invalidate cached todo", "todo_ids", todoIDs, "err", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api-v1/store"
+	"unicode/utf8"
+)
+
+const (
+	maxTagLength = 32
+	maxTodoTags  = 20
+)
+
+var errTagExists = &apiError{
+	Status:  http.StatusConflict,
+	Code:    codeConflict,
+	Message: "You already have a tag with this name",
+	Details: []fieldError{{"name", "is already taken"}},
+}
+
+// normalizeTag makes tag names case-insensitive.
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func normalizeTags(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	normalized := make([]string, len(names))
+	for i, name := range names {
+		normalized[i] = normalizeTag(name)
+	}
+	return normalized
+}
+
+// validateTagName checks a normalized name. Commas are reserved for listing
+// several tags in ?tag=.
+func validateTagName(field, name string) *fieldError {
+	switch {
+	case name == "":
+		return &fieldError{field, "must not be empty"}
+	case utf8.RuneCountInString(name) > maxTagLength:
+		return &fieldError{field, fmt.Sprintf("must be at most %d characters", maxTagLength)}
+	case strings.Contains(name, ","):
+		return &fieldError{field, "must not contain commas"}
+	}
+	return nil
+}
+
+// tagHandler serves /tags/ and /tags/{id}.
+func (s *Server) tagHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userKey).(int)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/tags/")
+	if idStr == "" {
+		switch r.Method {
+		case http.MethodGet:
+			tags, err := s.store.GetUserTags(ctx, userID)
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(tags)
+
+		case http.MethodPost:
+			name, ok := s.decodeTagName(w, r)
+			if !ok {
+				return
+			}
+			tag, err := s.store.CreateTag(ctx, userID, name)
+			if err != nil {
+				s.writeError(w, r, tagError(err))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(tag)
+
+		default:
+			s.writeError(w, r, errMethodNotAllowed)
+		}
+		return
+	}
+
+	tagID, err := strconv.Atoi(idStr)
+	if err != nil {
+		s.writeError(w, r, errBadRequest("Invalid tag ID"))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		name, ok := s.decodeTagName(w, r)
+		if !ok {
+			return
+		}
+		tag, err := s.store.RenameTag(ctx, userID, tagID, name)
+		if err != nil {
+			s.writeError(w, r, tagError(err))
+			return
+		}
+		// The user's cached todos still carry the old name.
+		s.invalidateUser(ctx, userID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tag)
+
+	case http.MethodDelete:
+		if err := s.store.DeleteTag(ctx, userID, tagID); err != nil {
+			s.writeError(w, r, tagError(err))
+			return
+		}
+		s.invalidateUser(ctx, userID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s.writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+// decodeTagName reads {"name": "..."} and answers 400 if it is unusable.
+func (s *Server) decodeTagName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeError(w, r, errBadRequest("Invalid request body"))
+		return "", false
+	}
+	name := normalizeTag(body.Name)
+	if fe := validateTagName("name", name); fe != nil {
+		s.writeError(w, r, errInvalid(*fe))
+		return "", false
+	}
+	return name, true
+}
+
+func tagError(err error) error {
+	switch {
+	case errors.Is(err, store.ErrTagExists):
+		return errTagExists
+	case errors.Is(err, store.ErrNotFound):
+		return errNotFound("Tag not found")
+	}
+	return err
+}
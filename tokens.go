@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"todo-api-v1/api"
+	"todo-api-v1/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+type tokenResponse struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Signer signs and verifies access tokens with an HMAC key.
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+func (sg *Signer) Sign(claims *api.Claims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(sg.key)
+}
+
+// Parse verifies tokenString as of now and returns its claims. Tokens signed
+// with anything but HS256 are rejected.
+func (sg *Signer) Parse(tokenString string, now time.Time) (*api.Claims, error) {
+	claims := &api.Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return sg.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// newAccessToken signs a short-lived JWT for the given user. tokenVersion is
+// the user's current version, see revokeAllTokens.
+func (s *Server) newAccessToken(userID, tokenVersion int) (string, time.Time, error) {
+	jti, err := newOpaqueToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expirationTime := s.now().Add(accessTokenTTL)
+	claims := &api.Claims{
+		UserID:       userID,
+		TokenVersion: tokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+		},
+	}
+
+	tokenString, err := s.signer.Sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expirationTime, nil
+}
+
+// newOpaqueToken returns a random URL-safe string with n bytes of entropy.
+func newOpaqueToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what we keep in the database instead of the refresh token itself.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens starts a new refresh token family for a fresh login.
+func (s *Server) issueTokens(ctx context.Context, user *api.User) (tokenResponse, error) {
+	familyID, err := newOpaqueToken(16)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	refreshToken, err := newOpaqueToken(32)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	err = s.store.CreateRefreshToken(ctx, user.ID, familyID, hashToken(refreshToken), s.now().Add(refreshTokenTTL))
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	accessToken, expiresAt, err := s.newAccessToken(user.ID, user.TokenVersion)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	return tokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+func (s *Server) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		s.writeError(w, r, errInvalid(fieldError{"refresh_token", "is required"}))
+		return
+	}
+
+	newRefreshToken, err := newOpaqueToken(32)
+	if err != nil {
+		s.writeError(w, r, fmt.Errorf("generate refresh token: %w", err))
+		return
+	}
+
+	userID, err := s.store.RotateRefreshToken(ctx, hashToken(body.RefreshToken), hashToken(newRefreshToken), s.now().Add(refreshTokenTTL))
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrRefreshTokenReused):
+			s.log(ctx).Warn("refresh token reuse detected, token family revoked")
+			s.writeError(w, r, errUnauthorized("Refresh token reuse detected, please log in again"))
+		case errors.Is(err, store.ErrRefreshTokenNotFound),
+			errors.Is(err, store.ErrRefreshTokenRevoked),
+			errors.Is(err, store.ErrRefreshTokenExpired):
+			s.writeError(w, r, errUnauthorized("Invalid refresh token"))
+		default:
+			s.writeError(w, r, fmt.Errorf("rotate refresh token: %w", err))
+		}
+		return
+	}
+
+	tokenVersion, err := s.store.GetTokenVersion(ctx, userID)
+	if err != nil {
+		s.writeError(w, r, fmt.Errorf("load token version: %w", err))
+		return
+	}
+
+	accessToken, expiresAt, err := s.newAccessToken(userID, tokenVersion)
+	if err != nil {
+		s.writeError(w, r, fmt.Errorf("sign access token: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokenResponse{
+		Token:        accessToken,
+		RefreshToken: newRefreshToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    expiresAt,
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"todo-api-v1/store"
+)
+
+// trashConfig controls how long deleted todos stay restorable.
+type trashConfig struct {
+	// Retention is how long a todo stays in the trash before it is purged.
+	Retention time.Duration
+	// PurgeInterval is how often the trash is checked for expired todos.
+	PurgeInterval time.Duration
+}
+
+// trashConfigFromEnv reads TRASH_RETENTION and TRASH_PURGE_INTERVAL, e.g.
+// "720h" and "1h".
+func trashConfigFromEnv() (trashConfig, error) {
+	cfg := trashConfig{Retention: 30 * 24 * time.Hour, PurgeInterval: time.Hour}
+	for name, dst := range map[string]*time.Duration{"TRASH_RETENTION": &cfg.Retention, "TRASH_PURGE_INTERVAL": &cfg.PurgeInterval} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return cfg, fmt.Errorf("%s must be a duration like 720h, got %q", name, v)
+			}
+			*dst = d
+		}
+	}
+	return cfg, nil
+}
+
+// runTrashPurger purges expired todos from the trash every cfg.PurgeInterval
+// until ctx is cancelled. Every replica runs it; purging twice is harmless.
+func (s *Server) runTrashPurger(ctx context.Context, cfg trashConfig) {
+	ticker := time.NewTicker(cfg.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		s.purgeTrash(ctx, cfg.Retention)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeTrash deletes the todos trashed more than retention ago.
+func (s *Server) purgeTrash(ctx context.Context, retention time.Duration) {
+	n, err := s.store.PurgeTrash(ctx, s.now().Add(-retention))
+	if err != nil {
+		if ctx.Err() == nil {
+			s.logger.Warn("failed to purge the trash", "err", err)
+		}
+		return
+	}
+	if n > 0 {
+		s.logger.Info("purged trashed todos", "count", n, "retention", retention)
+	}
+}
+
+// trashHandler serves /todos/trash, the user's deleted todos, and
+// /todos/trash/{id}, which purges one for good.
+func (s *Server) trashHandler(w http.ResponseWriter, r *http.Request, idStr string) {
+	userID, ok := r.Context().Value(userKey).(int)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	if idStr == "" {
+		if r.Method != http.MethodGet {
+			s.writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		query, err := parseTodoQuery(r)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		query.Trashed = true
+		page, err := s.store.GetUserTodos(ctx, userID, query)
+		if err != nil {
+			if errors.Is(err, store.ErrInvalidCursor) {
+				err = errInvalid(fieldError{"cursor", "is not a cursor returned for this sort"})
+			}
+			s.writeError(w, r, err)
+			return
+		}
+		writeTodoPage(w, r, page)
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		s.writeError(w, r, errBadRequest("Invalid Todo ID"))
+		return
+	}
+	if r.Method != http.MethodDelete {
+		s.writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	if err := s.store.PurgeUserTodo(ctx, userID, id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNotFound("Todo not found in the trash")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreTodo serves POST /todos/{id}/restore.
+func (s *Server) restoreTodo(w http.ResponseWriter, r *http.Request, id int) {
+	userID, ok := r.Context().Value(userKey).(int)
+	if !ok {
+		s.writeError(w, r, errUnauthorized("User not found in context"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	restored, err := s.store.RestoreUserTodo(ctx, userID, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			err = errNotFound("Todo not found in the trash")
+		}
+		s.writeError(w, r, err)
+		return
+	}
+	s.invalidateTodo(ctx, id)
+
+	writeTodo(w, r, http.StatusOK, restored)
+}
+
+// trashPath splits /todos/trash[/{id}] off the rest of /todos/.
+func trashPath(idStr string) (rest string, ok bool) {
+	if idStr == "trash" {
+		return "", true
+	}
+	return strings.CutPrefix(idStr, "trash/")
+}